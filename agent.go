@@ -1,9 +1,14 @@
 package sfab
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/jhunt/go-log"
@@ -24,9 +29,36 @@ const DefaultTimeout time.Duration = 30 * time.Second
 //
 // A Handler function returns two values: a Unix-style integer exit code,
 // and an error that (if non-nil) will terminate the Agent's main loop.
+// The one exception is an *ExitSignal error, which signals abnormal
+// termination of just this one execution to the Hub.
 //
 type Handler func(payload []byte, stdout io.Writer, stderr io.Writer) (rc int, err error)
 
+// A StreamHandler is a Handler that is also passed a context (which
+// identifies the Hub, via HubFromContext(), and is cancelled if the Hub
+// hangs up on the execution), and an input stream of whatever the Hub
+// caller sends via SendStream() (which is empty, otherwise), ahead of
+// the payload and output streams.  It returns the same two values that
+// a Handler does.
+//
+// StreamHandlers are what ConnectStream(), ConnectAll(), the Mux, and
+// all Middleware deal in; use a Handler's Stream() method to turn it
+// into one.
+//
+type StreamHandler func(ctx context.Context, payload []byte, stdin io.Reader, stdout io.Writer, stderr io.Writer) (rc int, err error)
+
+// Stream adapts a Handler into a StreamHandler that ignores its context
+// and input stream.
+//
+func (h Handler) Stream() StreamHandler {
+	if h == nil {
+		return nil
+	}
+	return func(_ context.Context, payload []byte, _ io.Reader, stdout, stderr io.Writer) (int, error) {
+		return h(payload, stdout, stderr)
+	}
+}
+
 // An Agent represents a client that connects to a Hub over SSH, and awaits
 // instructions on what to do.  Each Agent has an identity (its name and
 // private key).
@@ -45,9 +77,125 @@ type Agent struct {
 	//
 	Timeout time.Duration
 
+	// How long to wait before reconnecting to a Hub, after the
+	// connection goes away (or cannot be made), via ConnectAll().
+	//
+	// Defaults to DefaultReconnectInterval.
+	//
+	ReconnectInterval time.Duration
+
+	// How often to check whether a more preferred Hub is back,
+	// while connected to a fallback Hub via ConnectFailover() or
+	// ConnectSRV().
+	//
+	// Defaults to DefaultFailbackInterval.
+	//
+	FailbackInterval time.Duration
+
+	// The resolver to use for looking up DNS SRV records, via
+	// ConnectSRV().  Defaults to the system resolver.
+	//
+	Resolver Resolver
+
+	// How to make the network connections to Hubs, i.e. through an
+	// HTTP or SOCKS5 proxy (see HTTPProxyDialer() and friends).
+	//
+	// Defaults to EnvironmentDialer(), which honors the standard
+	// HTTPS_PROXY, ALL_PROXY and NO_PROXY environment variables.
+	//
+	Dialer Dialer
+
+	// An optional function for choosing the HTTP (or SOCKS5) proxy
+	// to go through, when connecting to a Hub over a WebSocket (i.e.
+	// via a wss:// URL), like the one in net/http's Transport.  If
+	// set, it overrides the Dialer's choice of proxy.
+	//
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// TLS configuration (i.e. trusted CAs) for connecting to a Hub
+	// over a secure WebSocket (wss://).  The SSH transport inside
+	// still verifies the Hub's host key, regardless.
+	//
+	TLSConfig *tls.Config
+
+	// Path to an OpenSSH known_hosts-style file of trusted Hub
+	// host keys.  Hub host keys that have been authorized via
+	// AuthorizeKey() are checked first; if a Hub presents a key
+	// that isn't explicitly authorized, it must be listed in
+	// this file.
+	//
+	KnownHostsFile string
+
+	// Whether or not to trust (and record in KnownHostsFile) the
+	// host key of any Hub that isn't already listed in the file.
+	// Once recorded, a Hub that presents a different host key is
+	// refused with a HostKeyChangedError.
+	//
+	TrustOnFirstUse bool
+
+	// An optional handler for interactive terminal sessions, opened
+	// by the Hub via OpenPTY().  If this is not set, the Agent will
+	// refuse to allocate pseudo-terminals.  See Shell() for running
+	// a login shell under a real (Linux) pseudo-terminal.
+	//
+	Interactive TerminalHandler
+
+	// Directories that the Hub is allowed to push files into, and
+	// pull files out of, via PushFile() and PullFile().  If this is
+	// empty, the Agent refuses all file transfers.
+	//
+	FileRoots []string
+
+	// Destinations (as host:port) that the Hub is allowed to open
+	// TCP connections to, through this Agent, via Dial().  Hosts
+	// can be glob patterns (i.e. `*.db.example.com`) or CIDR ranges
+	// (i.e. `10.0.0.0/8`, which only match destinations given as IP
+	// addresses), and ports can be `*`, to allow any port.  If this
+	// (and ExposePorts) is empty, the Agent refuses all forwarding.
+	//
+	ForwardTo []string
+
+	// Local TCP ports (on the loopback interface) that the Hub is
+	// allowed to reach through this Agent, via Dial(), i.e. for
+	// proxying HTTP requests to agent-local metrics endpoints or
+	// admin pages (see the proxy package).
+	//
+	ExposePorts []int
+
+	// An optional callback that receives an AuditEvent for each
+	// security-relevant action the Agent takes on behalf of a Hub,
+	// like opening (and closing) an interactive terminal session.
+	// Audit events are always logged, regardless.
+	//
+	OnAudit AuditCallback
+
 	// A helper object for authorizing Hub host keys by name or IP.
 	//
 	keys *KeyMaster
+
+	// Concurrency guard, for access to the live connections
+	// from goroutines other than the ones running Connect().
+	//
+	lk sync.Mutex
+
+	// The SSH connections to Hubs, while Connect() (or
+	// ConnectAll()) is running, in the order they were made.
+	//
+	conns []hubConn
+
+	// The state of each Hub that this Agent has tried to
+	// connect to, in the order they were first tried.
+	//
+	hubs []*HubState
+
+	// RPC services registered via Register() / RegisterName().
+	//
+	services map[string]*rpcService
+
+	// The Hub whose agents this Agent exposes to its upstream
+	// Hub(s), when acting as a relay (see Hub.ConnectUpstream()).
+	//
+	downstream *Hub
 }
 
 // Instruct the Agent to (insecurely) accept any host key presented by the
@@ -55,14 +203,17 @@ type Agent struct {
 // be useful in development or debugging scenarios.
 //
 // Note: calling this function will obliterate any keys authorized by
-// the AuthorizeKey() method.
+// the AuthorizeKey() method, and stop consulting the KnownHostsFile.
 //
 func (a *Agent) AcceptAnyHostKey() {
 	a.keys = nil
+	a.KnownHostsFile = ""
 }
 
 // Authorize a specific Hub Host Key, which will be accepted from any Hub
-// with the name or IP address given as `host`.
+// with the name or IP address given as `host`.  The `host` can also be a
+// glob pattern (i.e. `*.hubs.example.com`) or a CIDR network range (i.e.
+// `10.0.0.0/8`).
 //
 func (a *Agent) AuthorizeKey(host string, key *Key) {
 	if a.keys == nil {
@@ -78,6 +229,27 @@ func (a *Agent) AuthorizeKey(host string, key *Key) {
 // is best run in a goroutine.
 //
 func (a *Agent) Connect(proto, host string, handler Handler) error {
+	return a.ConnectStream(proto, host, handler.Stream())
+}
+
+// ConnectStream connects to a remote sFAB Hub, exactly as Connect() does,
+// but responds to execution requests with the passed StreamHandler, which
+// can read input streamed from the Hub caller, and find out when the Hub
+// hangs up on it.
+//
+func (a *Agent) ConnectStream(proto, host string, handler StreamHandler) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+
+	_, err := a.connect(context.Background(), proto, host, a.rpc(handler))
+	return err
+}
+
+// validate checks that the Agent has everything it needs to connect to
+// a Hub, and fills in defaults for anything optional that it is missing.
+//
+func (a *Agent) validate() error {
 	if a.Identity == "" {
 		return fmt.Errorf("missing identity")
 	}
@@ -89,83 +261,432 @@ func (a *Agent) Connect(proto, host string, handler Handler) error {
 	if a.Timeout == 0 {
 		a.Timeout = DefaultTimeout
 	}
+	return nil
+}
+
+// connect to a single Hub, and service its requests with the Handler,
+// until either the connection goes away, the context is done, or the
+// Handler asks for the Agent to terminate, in which case halted is
+// returned as true.
+//
+func (a *Agent) connect(ctx context.Context, proto, host string, handler StreamHandler) (halted bool, err error) {
+	return a.resume(ctx, proto, host, nil, handler)
+}
+
+// resume is connect(), for when we may already have gone through the
+// SSH handshake with the Hub (i.e. when probing it for failback), in
+// which case we pick up where that left off, rather than dialing.
+//
+func (a *Agent) resume(ctx context.Context, proto, host string, link *hubLink, handler StreamHandler) (halted bool, err error) {
+	a.hubState(host, func(st *HubState) {
+		st.Attempts++
+	})
+	defer func() {
+		a.hubState(host, func(st *HubState) {
+			st.Connected = false
+			st.Since = time.Now()
+			st.LastError = err
+		})
+	}()
+
+	if link == nil {
+		log.Debugf("[agent %s] connecting to %s over %s (for up to %fs)...", a.Identity, host, proto, a.Timeout.Seconds())
+		socket, err := a.dial(ctx, proto, host)
+		if err != nil {
+			return false, err
+		}
+
+		link, err = a.handshake(host, socket)
+		if err != nil {
+			return false, err
+		}
+	}
+	return a.run(ctx, host, link, handler)
+}
 
-	config := &ssh.ClientConfig{
-		User:    a.Identity,
-		Auth:    []ssh.AuthMethod{ssh.PublicKeys(a.PrivateKey.signer)},
-		Timeout: a.Timeout,
+// dial connects to a Hub, either over raw TCP, or over a WebSocket,
+// for "ws" and "wss" protocols (or ws:// and wss:// URLs).
+//
+func (a *Agent) dial(ctx context.Context, proto, host string) (net.Conn, error) {
+	if isWebSocket(proto, host) {
+		return a.dialWebSocket(ctx, proto, host)
+	}
+
+	return a.dialer().DialContext(ctx, proto, host)
+}
+
+// dialer returns the Agent's Dialer, or the default one, which honors
+// the standard proxy environment variables.
+//
+func (a *Agent) dialer() Dialer {
+	if a.Dialer != nil {
+		return a.Dialer
 	}
-	if a.keys != nil {
-		config.HostKeyCallback = a.keys.hostKeyCallback()
-	} else {
-		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	return EnvironmentDialer(&net.Dialer{Timeout: a.Timeout})
+}
+
+// clientConfig builds the SSH client configuration that the Agent
+// uses to authenticate to its Hubs, and to check their host keys.
+//
+func (a *Agent) clientConfig() (*ssh.ClientConfig, *hostKeyChecker) {
+	a.lk.Lock()
+	key := a.PrivateKey
+	a.lk.Unlock()
+
+	checker := &hostKeyChecker{
+		keys:  a.keys,
+		file:  a.KnownHostsFile,
+		tofu:  a.TrustOnFirstUse,
+		agent: a.Identity,
 	}
+	return &ssh.ClientConfig{
+		User:            a.Identity,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(key.signer)},
+		Timeout:         a.Timeout,
+		HostKeyCallback: checker.check,
+	}, checker
+}
+
 
-	log.Debugf("[agent %s] connecting to %s over %s (for up to %fs)...", a.Identity, host, proto, a.Timeout.Seconds())
-	socket, err := net.DialTimeout(proto, host, a.Timeout)
+// serve negotiates the SSH transport (as the client) with a Hub, over
+// an already connected socket, regardless of which end dialed it, and
+// then services the Hub's requests with the Handler, until either the
+// connection goes away, the context is done, or the Handler asks for
+// the Agent to terminate, in which case halted is returned as true.
+//
+func (a *Agent) serve(ctx context.Context, host string, socket net.Conn, handler StreamHandler) (halted bool, err error) {
+	link, err := a.handshake(host, socket)
 	if err != nil {
-		return err
+		return false, err
 	}
+	return a.run(ctx, host, link, handler)
+}
+
+// A hubLink is an SSH connection to a Hub that has made it through
+// the handshake, but has yet to be serviced.
+//
+type hubLink struct {
+	conn  ssh.Conn
+	chans <-chan ssh.NewChannel
+	reqs  <-chan *ssh.Request
+}
+
+// handshake negotiates the SSH transport with a Hub, over an already
+// connected socket, checking its host key and authenticating to it.
+// On failure, the socket is closed.
+//
+func (a *Agent) handshake(host string, socket net.Conn) (*hubLink, error) {
+	config, checker := a.clientConfig()
 
 	log.Debugf("[agent %s] starting SSH transport negotiation with hub...", a.Identity)
-	conn, chans, reqs, err := ssh.NewClientConn(socket, host, config)
+	conn, chans, reqs, err := ssh.NewClientConn(socket, hubAddress(host), config)
 	if err != nil {
-		return err
+		socket.Close()
+		if checker.err != nil {
+			return nil, checker.err
+		}
+		return nil, err
 	}
+	return &hubLink{conn: conn, chans: chans, reqs: reqs}, nil
+}
+
+// run services the requests that come in over an SSH connection to a
+// Hub, as for serve().
+//
+func (a *Agent) run(ctx context.Context, host string, link *hubLink, handler StreamHandler) (halted bool, err error) {
+	conn, chans, reqs := link.conn, link.chans, link.reqs
 	defer conn.Close()
 
-	log.Debugf("[agent %s] ignoring global requests (keepalives, mostly) from hub...", a.Identity)
-	go ignoreGlobalRequests(reqs)
+	a.lk.Lock()
+	a.conns = append(a.conns, hubConn{host: host, conn: conn})
+	a.lk.Unlock()
+	defer func() {
+		a.lk.Lock()
+		for i, hc := range a.conns {
+			if hc.conn == conn {
+				a.conns = append(a.conns[:i], a.conns[i+1:]...)
+				break
+			}
+		}
+		a.lk.Unlock()
+	}()
+
+	a.hubState(host, func(st *HubState) {
+		st.Connected = true
+		st.Since = time.Now()
+		st.Attempts = 0
+		st.LastError = nil
+	})
+
+	/* hang up on the hub when the caller tells us to */
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	log.Debugf("[agent %s] servicing global requests (keepalives, mostly) from hub...", a.Identity)
+	go a.serviceRequests(conn, host, reqs)
 
 	log.Debugf("[agent %s] awaiting channel requests from hub...", a.Identity)
 	for newch := range chans {
 		log.Debugf("[agent %s] inbound channel type '%s' from hub...", a.Identity, newch.ChannelType())
 
-		if newch.ChannelType() != "session" {
+		switch newch.ChannelType() {
+		case "session":
+		case "direct-tcpip":
+			go a.forward(host, newch)
+			continue
+		case PeerChannelType:
+			if a.downstream != nil {
+				go a.downstream.forwarded(newch)
+			} else {
+				newch.Reject(ssh.UnknownChannelType, "not a relay hub")
+			}
+			continue
+		default:
 			newch.Reject(ssh.UnknownChannelType, "buh-bye!")
+			continue
 		}
 
 		log.Debugf("[agent %s] accepting '%s' request and starting up channel...", a.Identity, newch.ChannelType())
 		ch, reqs, err := newch.Accept()
 		if err != nil {
 			log.Errorf("[agent %s] failed to accept new '%s' channel: %s", a.Identity, newch.ChannelType(), err)
-			return nil
+			return false, nil
 		}
 
-		for r := range reqs {
-			log.Debugf("[agent %s] request type '%s' received.", a.Identity, r.Type)
+		detached, err := a.serveSession(host, handler, ch, reqs)
+		if err != nil {
+			log.Errorf("[agent %s] handler returned error: %s", a.Identity, err)
+			log.Errorf("[agent %s] terminating...", a.Identity)
+
+			log.Debugf("[agent %s] closing connection...", a.Identity)
+			ch.Close()
+			return true, nil
+		}
+
+		if detached {
+			log.Debugf("[agent %s] channel handed off; leaving it to run...", a.Identity)
+			continue
+		}
+
+		log.Debugf("[agent %s] closing connection...", a.Identity)
+		ch.Close()
+
+		log.Debugf("[agent %s] awaiting channel requests from hub...", a.Identity)
+	}
+	return false, nil
+}
 
-			if r.Type != "exec" {
+// Service a single session channel from the Hub: wait for its "exec"
+// request, and then run the Handler against the payload, with the
+// channel itself as standard input, before reporting the outcome (the
+// exit status, or an exit signal) back to the Hub.
+//
+// The context passed to the Handler carries the address of the Hub
+// (see HubFromContext), and is cancelled as soon as the Hub closes the
+// channel (or the connection goes away).
+//
+// If the Hub asks for a pseudo-terminal instead (and the Agent has an
+// Interactive handler), or for the file transfer subsystem (and the
+// Agent has FileRoots), the channel is handed off to a goroutine, and
+// serveSession returns immediately, with detached set to true; the
+// caller must not close the channel.
+//
+// Any (non-ExitSignal) error returned by the Handler is returned, so
+// that the caller can terminate the Agent.
+//
+func (a *Agent) serveSession(host string, handler StreamHandler, ch ssh.Channel, reqs <-chan *ssh.Request) (detached bool, err error) {
+	for r := range reqs {
+		log.Debugf("[agent %s] request type '%s' received.", a.Identity, r.Type)
+
+		if r.Type == "pty-req" {
+			var req ptyRequest
+			if a.Interactive == nil {
+				log.Infof("[agent %s] refusing pseudo-terminal request from hub; no interactive handler configured", a.Identity)
+				r.Reply(false, nil)
+				continue
+			}
+			if err := ssh.Unmarshal(r.Payload, &req); err != nil {
+				log.Errorf("[agent %s] unable to unmarshal pseudo-terminal request from upstream hub: %s", a.Identity, err)
 				r.Reply(false, nil)
 				continue
 			}
 
 			r.Reply(true, nil)
-			var payload struct{ Value []byte }
-			if err := ssh.Unmarshal(r.Payload, &payload); err != nil {
-				log.Errorf("[agent %s] unable to unmarshal payload from upstream hub: %s", a.Identity, err)
+			go a.serveTerminal(host, ch, reqs, req)
+			return true, nil
+		}
+
+		if r.Type == "subsystem" {
+			var sub struct{ Name string }
+			if err := ssh.Unmarshal(r.Payload, &sub); err != nil || sub.Name != FileSubsystem || len(a.FileRoots) == 0 {
+				log.Infof("[agent %s] refusing subsystem request from hub", a.Identity)
+				r.Reply(false, nil)
 				continue
 			}
 
-			log.Debugf("[agent %s] received `exec' payload of [%s]", a.Identity, string(payload.Value))
-			rc, err := handler(payload.Value, ch, ch.Stderr())
-			ch.SendRequest("exit-status", false, exited(rc))
-			if err != nil {
-				log.Errorf("[agent %s] handler returned error: %s", a.Identity, err)
-				log.Errorf("[agent %s] terminating...", a.Identity)
+			r.Reply(true, nil)
+			go a.serveFiles(host, ch, reqs)
+			return true, nil
+		}
+
+		if r.Type != "exec" {
+			r.Reply(false, nil)
+			continue
+		}
+
+		r.Reply(true, nil)
+		var payload struct{ Value []byte }
+		if err := ssh.Unmarshal(r.Payload, &payload); err != nil {
+			log.Errorf("[agent %s] unable to unmarshal payload from upstream hub: %s", a.Identity, err)
+			continue
+		}
 
-				log.Debugf("[agent %s] closing connection...", a.Identity)
-				ch.Close()
-				return nil
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), hubContextKey{}, host))
+		defer cancel()
+		go func() {
+			for r := range reqs {
+				r.Reply(false, nil)
 			}
+			cancel()
+		}()
 
-			break
+		log.Debugf("[agent %s] received `exec' payload of [%s]", a.Identity, string(payload.Value))
+		rc, err := handler(ctx, payload.Value, ch, ch, ch.Stderr())
+		if sig, ok := err.(*ExitSignal); ok {
+			log.Errorf("[agent %s] handler terminated abnormally: %s", a.Identity, sig)
+			ch.SendRequest("exit-signal", false, sig.marshal())
+			return false, nil
 		}
+		ch.SendRequest("exit-status", false, exited(rc))
+		return false, err
+	}
+	return false, nil
+}
 
-		log.Debugf("[agent %s] closing connection...", a.Identity)
-		ch.Close()
+// Handle global requests from the Hub, learning any new host keys
+// it advertises, and ignoring everything else (keepalives, mostly).
+//
+// This method is meant to be called in a goroutine.
+//
+func (a *Agent) serviceRequests(conn ssh.Conn, host string, in <-chan *ssh.Request) {
+	for r := range in {
+		switch r.Type {
+		case HostKeysRequestName:
+			go a.learnHostKeys(conn, host, conn.RemoteAddr(), r.Payload)
 
-		log.Debugf("[agent %s] awaiting channel requests from hub...", a.Identity)
+		default:
+			r.Reply(false, nil)
+		}
+	}
+}
+
+// Connected returns true if this Agent currently has a live
+// connection to (at least one) Hub.
+//
+func (a *Agent) Connected() bool {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	return len(a.conns) > 0
+}
+
+// connection returns the oldest live SSH connection to a Hub, if there
+// is one.
+//
+func (a *Agent) connection() (ssh.Conn, error) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if len(a.conns) == 0 {
+		return nil, fmt.Errorf("not connected to a hub")
+	}
+	return a.conns[0].conn, nil
+}
+
+// connections returns all of the live SSH connections to Hubs.
+//
+func (a *Agent) connections() []hubConn {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	return append([]hubConn{}, a.conns...)
+}
+
+// RotateKey asks every Hub that this Agent is currently connected to
+// to start trusting a new key pair for this Agent's identity.  The
+// request is signed by the Agent's current private key.
+//
+// Once all of the Hubs have accepted the rotation, the Agent will use
+// the new key for all subsequent connections.  The current connections
+// stay up (with the old key) until the Hubs retire the old key.
+//
+func (a *Agent) RotateKey(next *Key) error {
+	if next == nil || !next.IsPrivateKey() {
+		return fmt.Errorf("missing new private key")
+	}
+
+	a.lk.Lock()
+	key := a.PrivateKey
+	a.lk.Unlock()
+
+	r, err := NewRotation(a.Identity, key, next)
+	if err != nil {
+		return err
+	}
+	return a.SubmitRotation(r, next)
+}
+
+// SubmitRotation sends a pre-generated Rotation (i.e. one created by
+// `sfab rotate`) to every Hub that this Agent is currently connected
+// to.  The next key pair must match the public key in the Rotation;
+// once every Hub accepts the rotation, the Agent switches over to it
+// for all subsequent connections.
+//
+// If any Hub refuses, the Agent keeps its current key, and the first
+// refusal is returned.  Hubs that did accept will retire the current
+// key once their RotationOverlap is up, so the rotation ought to be
+// sorted out (and retried) before then.
+//
+func (a *Agent) SubmitRotation(r *Rotation, next *Key) error {
+	if next == nil || !next.IsPrivateKey() {
+		return fmt.Errorf("missing new private key")
+	}
+	if r.NewKey == nil || r.NewKey.Fingerprint() != next.Fingerprint() {
+		return fmt.Errorf("new private key does not match the key rotation")
+	}
+
+	/* every hub has to know about the new key, or we'll be
+	   locked out of the ones that don't, next time we connect */
+	conns := a.connections()
+	if len(conns) == 0 {
+		return fmt.Errorf("not connected to a hub")
 	}
+
+	var failed error
+	for _, hc := range conns {
+		log.Infof("[agent %s] requesting rotation to key [%s] from hub %s...", a.Identity, next.Fingerprint(), hc.host)
+		ok, msg, err := hc.conn.SendRequest(RotationRequestName, true, r.Marshal())
+		if err == nil && !ok {
+			if len(msg) == 0 {
+				err = fmt.Errorf("key rotation refused by hub %s", hc.host)
+			} else {
+				err = fmt.Errorf("key rotation refused by hub %s: %s", hc.host, string(msg))
+			}
+		}
+		if err != nil && failed == nil {
+			failed = err
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+
+	a.lk.Lock()
+	a.PrivateKey = next
+	a.lk.Unlock()
 	return nil
 }
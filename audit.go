@@ -0,0 +1,53 @@
+package sfab
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jhunt/go-log"
+)
+
+// An AuditEvent records something security-relevant that an Agent did
+// on behalf of a Hub, beyond running its Handler, like opening up an
+// interactive terminal session.
+//
+type AuditEvent struct {
+	// When the event happened.
+	//
+	Time time.Time
+
+	// The identity of the Agent, and the Hub it is connected to.
+	//
+	Agent string
+	Hub   string
+
+	// What happened, i.e. "pty-open", "file-push" or "forward-open".
+	//
+	Kind string
+
+	// Human-readable details about the event.
+	//
+	Detail string
+}
+
+// An AuditCallback is called with each AuditEvent, as it happens.
+//
+type AuditCallback func(AuditEvent)
+
+// audit logs an AuditEvent, and passes it on to the Agent's OnAudit
+// callback, if it has one.
+//
+func (a *Agent) audit(hub, kind, format string, args ...interface{}) {
+	ev := AuditEvent{
+		Time:   time.Now(),
+		Agent:  a.Identity,
+		Hub:    hub,
+		Kind:   kind,
+		Detail: fmt.Sprintf(format, args...),
+	}
+
+	log.Infof("[agent %s] audit: %s (hub %s): %s", a.Identity, ev.Kind, ev.Hub, ev.Detail)
+	if a.OnAudit != nil {
+		a.OnAudit(ev)
+	}
+}
@@ -0,0 +1,388 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+)
+
+// The SSH user name that Hubs authenticate to their peers as, when
+// setting up hub-to-hub links within a cluster.  No agent may use
+// this identity.
+//
+const PeerUser = "sfab-hub"
+
+// The SSH channel type that Hubs open to their peers, to forward
+// messages to agents that are connected to those peers.
+//
+const PeerChannelType = "sfab-forward"
+
+// The SSH permissions extension that marks an inbound connection
+// as a link from a (trusted) peer Hub, rather than from an agent.
+//
+const PeerExtensionName = "sfab-peer"
+
+// How long to wait for a peer Hub to complete a new link.
+//
+const peerTimeout time.Duration = 30 * time.Second
+
+// The wire format of a forwarded message, as the extra data of the
+// channel open request.  Timeout is how long (in milliseconds) the
+// peer should wait for the agent to pick the message up; zero means
+// there is no limit.
+//
+type peerRequest struct {
+	Agent   string
+	Payload []byte
+	Timeout uint32
+}
+
+// AuthorizePeer tells the Hub to trust another Hub in its cluster,
+// given the public component of that Hub's host key, both to accept
+// links from it, and to verify it before forwarding messages to it.
+// Peers authenticate with their (first) host key, so each Hub in the
+// cluster must authorize the host keys of all the others.
+//
+// This can be called dynamically, long after a call to Listen(),
+// or before.
+//
+func (h *Hub) AuthorizePeer(key *Key) {
+	h.lock()
+	defer h.unlock()
+
+	log.Debugf("authorizing peer hub with key [%s]", key.Fingerprint())
+	h.peerKeys = append(h.peerKeys, key)
+}
+
+// isPeer checks whether a key belongs to a trusted peer Hub.
+//
+func (h *Hub) isPeer(key ssh.PublicKey) bool {
+	h.lock()
+	defer h.unlock()
+
+	fp := ssh.FingerprintSHA256(key)
+	for _, k := range h.peerKeys {
+		if k.Fingerprint() == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticatePeer authenticates an inbound link from a peer Hub.
+//
+func (h *Hub) authenticatePeer(key ssh.PublicKey) (*ssh.Permissions, error) {
+	if !h.isPeer(key) {
+		return nil, fmt.Errorf("unknown or unauthorized peer hub key")
+	}
+	return &ssh.Permissions{
+		Extensions: map[string]string{
+			PeerExtensionName: ssh.FingerprintSHA256(key),
+		},
+	}, nil
+}
+
+// checkPeer verifies the host key of a peer Hub that we are
+// setting up an outbound link to.
+//
+func (h *Hub) checkPeer(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if !h.isPeer(key) {
+		return fmt.Errorf("hub %s presented untrusted host key [%s]", hostname, ssh.FingerprintSHA256(key))
+	}
+	return nil
+}
+
+// peerAddress returns the address that peers use to reach this Hub.
+//
+func (h *Hub) peerAddress() string {
+	if h.PeerAddress != "" {
+		return h.PeerAddress
+	}
+	_, address := h.bindAddress(h.Bind)
+	return address
+}
+
+// checkPeerAddress makes sure that a clustered Hub has an address
+// that its peers can actually dial.  Wildcard binds (0.0.0.0:4771,
+// [::]:4771 or just :4771) and Unix domain sockets won't do; those
+// Hubs need an explicit PeerAddress.
+//
+func (h *Hub) checkPeerAddress() error {
+	if h.Cluster == nil {
+		return nil
+	}
+
+	addr := h.peerAddress()
+	if h.PeerAddress == "" {
+		if network, _ := h.bindAddress(h.Bind); network == "unix" {
+			return fmt.Errorf("clustered hub listens on a unix socket (%s); set a PeerAddress that peers can dial", h.Bind)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid peer address '%s': %s", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return fmt.Errorf("peers cannot dial %s; set a PeerAddress with a routable host", addr)
+	}
+	return nil
+}
+
+// enlist registers a newly connected agent with the cluster.
+//
+func (h *Hub) enlist(agent string) {
+	if h.Cluster == nil {
+		return
+	}
+	if err := h.Cluster.Register(agent, h.peerAddress()); err != nil {
+		log.Errorf("[hub] unable to register agent '%s' with the cluster: %s", agent, err)
+	}
+}
+
+// delist deregisters a disconnected agent from the cluster.
+//
+func (h *Hub) delist(agent string) {
+	if h.Cluster == nil {
+		return
+	}
+	if err := h.Cluster.Deregister(agent, h.peerAddress()); err != nil {
+		log.Errorf("[hub] unable to deregister agent '%s' from the cluster: %s", agent, err)
+	}
+}
+
+// locate finds the peer Hub that an agent is connected to, if any.
+//
+func (h *Hub) locate(agent string) (string, bool) {
+	if h.Cluster == nil {
+		return "", false
+	}
+
+	peer, found, err := h.Cluster.Lookup(agent)
+	if err != nil {
+		log.Errorf("[hub] unable to look up agent '%s' in the cluster: %s", agent, err)
+		return "", false
+	}
+	if !found || peer == h.peerAddress() {
+		return "", false
+	}
+	return peer, true
+}
+
+// peer returns the live SSH link to a peer Hub, setting one up
+// if we don't already have one.
+//
+func (h *Hub) peer(addr string) (ssh.Conn, error) {
+	h.lock()
+	conn, ok := h.peers[addr]
+	keys := h.hostKeys()
+	h.unlock()
+
+	if ok {
+		return conn, nil
+	}
+	if len(keys) == 0 || keys[0].signer == nil {
+		return nil, fmt.Errorf("missing HostKey in Hub object.")
+	}
+
+	log.Infof("[hub] setting up peer link to hub %s...", addr)
+	socket, err := net.DialTimeout("tcp", addr, peerTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(socket, addr, &ssh.ClientConfig{
+		User:            PeerUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(keys[0].signer)},
+		Timeout:         peerTimeout,
+		HostKeyCallback: h.checkPeer,
+	})
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for newch := range chans {
+			newch.Reject(ssh.Prohibited, fmt.Sprintf("read my lips -- no new %s channels", newch.ChannelType()))
+		}
+	}()
+
+	h.lock()
+	if existing, ok := h.peers[addr]; ok {
+		h.unlock()
+		c.Close()
+		return existing, nil
+	}
+	if h.peers == nil {
+		h.peers = make(map[string]ssh.Conn)
+	}
+	h.peers[addr] = c
+	h.unlock()
+
+	go func() {
+		c.Wait()
+		h.dropPeer(addr, c)
+	}()
+	return c, nil
+}
+
+// dropPeer closes (and forgets) a link to a peer Hub, so that the
+// next message for that peer sets up a new one.
+//
+func (h *Hub) dropPeer(addr string, conn ssh.Conn) {
+	h.lock()
+	if h.peers[addr] == conn {
+		delete(h.peers, addr)
+		log.Infof("[hub] peer link to hub %s closed", addr)
+	}
+	h.unlock()
+	conn.Close()
+}
+
+// forward sends a message to an agent that is connected to a peer
+// Hub, over the link to that peer.  Output and the exit status come
+// back just as if the agent were connected to this Hub.
+//
+func (h *Hub) forward(ctx context.Context, peer, agent string, msg Message) (chan *Response, error) {
+	conn, err := h.peer(peer)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach hub %s (for agent %s): %s", peer, agent, err)
+	}
+
+	log.Debugf("[hub] forwarding message for agent '%s' to hub %s...", agent, peer)
+
+	responses, err := forwardOver(ctx, conn, agent, msg)
+	if err != nil {
+		if oc, ok := err.(*ssh.OpenChannelError); ok {
+			return nil, fmt.Errorf("%s (via hub %s)", oc.Message, peer)
+		}
+		h.dropPeer(peer, conn)
+		return nil, err
+	}
+	return responses, nil
+}
+
+// forwardOver forwards a message for an agent over an SSH link to
+// another Hub (either a peer, or a downstream relay hub), which will
+// deliver it to the agent, via forwarded().
+//
+func forwardOver(ctx context.Context, conn ssh.Conn, agent string, msg Message) (chan *Response, error) {
+	req := peerRequest{
+		Agent:   agent,
+		Payload: msg.payload,
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		ms := time.Until(deadline) / time.Millisecond
+		if ms < 1 {
+			ms = 1
+		}
+		req.Timeout = uint32(ms)
+	}
+
+	channel, requests, err := openChannel(ctx, conn, PeerChannelType, ssh.Marshal(&req))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &session{
+		channel:  channel,
+		requests: requests,
+		exit:     make(chan status, 1),
+		raw:      msg.raw,
+		stdin:    msg.stdin,
+		ctx:      msg.ctx,
+	}
+	go s.serviceRequests()
+
+	responses := make(chan *Response)
+	go s.finish(responses, nil)
+	return responses, nil
+}
+
+// servePeer (which ought to be run in a goroutine) handles a link
+// from a peer Hub, delivering the messages it forwards to agents
+// connected to this Hub, and refusing everything else.
+//
+func (h *Hub) servePeer(conn *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go ssh.DiscardRequests(reqs)
+
+	for newch := range chans {
+		switch newch.ChannelType() {
+		case PeerChannelType:
+			go h.forwarded(newch)
+
+		default:
+			newch.Reject(ssh.Prohibited, fmt.Sprintf("read my lips -- no new %s channels", newch.ChannelType()))
+		}
+	}
+	log.Infof("[hub] peer link from hub %s closed", conn.RemoteAddr())
+}
+
+// forwarded handles a message forwarded by a peer Hub, delivering it
+// to the target agent (if it is connected to this Hub), and relaying
+// its input, output and exit status back and forth.
+//
+func (h *Hub) forwarded(newch ssh.NewChannel) {
+	var req peerRequest
+	if err := ssh.Unmarshal(newch.ExtraData(), &req); err != nil {
+		newch.Reject(ssh.ConnectionFailed, "malformed forwarded message")
+		return
+	}
+
+	/* abort the execution if the peer hangs up */
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pickup := ctx
+	if req.Timeout > 0 {
+		var done context.CancelFunc
+		pickup, done = context.WithTimeout(ctx, time.Duration(req.Timeout)*time.Millisecond)
+		defer done()
+	}
+
+	/* we can't accept the channel until we know the agent has
+	   picked up the message, so its input goes through a pipe */
+	stdin, feed := io.Pipe()
+	defer stdin.Close()
+
+	log.Infof("[hub] delivering message forwarded by another hub to agent '%s'", req.Agent)
+	responses, err := h.send(pickup, req.Agent, Message{
+		payload: req.Payload,
+		raw:     true,
+		stdin:   stdin,
+		ctx:     ctx,
+		local:   true,
+	})
+	if err != nil {
+		newch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	ch, reqs, err := newch.Accept()
+	if err != nil {
+		log.Errorf("[hub] failed to accept forwarded message for agent '%s': %s", req.Agent, err)
+		cancel()
+		h.IgnoreReplies(responses)
+		return
+	}
+	defer ch.Close()
+
+	go func() {
+		io.Copy(feed, ch)
+		feed.Close()
+	}()
+	go func() {
+		for r := range reqs {
+			r.Reply(false, nil)
+		}
+		cancel()
+	}()
+
+	relayResponses(ch, responses)
+}
@@ -31,6 +31,10 @@ var opts struct {
 		Public  bool `cli:"-p, --public, --pub, --no-public, --no-pub"`
 		Fingerprint bool `cli:"-f, --fingerprint"`
 	} `cli:"key"`
+
+	Rotate struct {
+		Identity string `cli:"-i, --identity" env:"SFAB_IDENTITY"`
+	} `cli:"rotate"`
 }
 
 func main() {
@@ -79,6 +83,13 @@ func main() {
 		fmt.Printf("                    and prints its fingerprint.\n")
 		fmt.Printf("                    Has no effect if --quiet is set.\n")
 		fmt.Printf("\n")
+		fmt.Printf("  @G{rotate} @C{OLD} @C{NEW}    Generate signed key rotation material, for an\n")
+		fmt.Printf("                    agent to rotate from its OLD private key to a\n")
+		fmt.Printf("                    NEW key pair.\n")
+		fmt.Printf("\n")
+		fmt.Printf("    -i, --identity  The agent identity to rotate keys for.\n")
+		fmt.Printf("                    (defaults to @W{$SFAB_IDENTITY})\n")
+		fmt.Printf("\n")
 		os.Exit(0)
 	}
 
@@ -183,6 +194,46 @@ func main() {
 		}
 		os.Exit(0)
 
+	} else if command == "rotate" {
+		if len(args) != 2 {
+			fmt.Fprintf(os.Stderr, "USAGE: sfab rotate -i IDENTITY @Y{OLD} @Y{NEW}\n")
+			fmt.Fprintf(os.Stderr, "missing required @Y{OLD} and/or @Y{NEW} key arguments!\n")
+			os.Exit(1)
+		}
+		if opts.Rotate.Identity == "" {
+			fmt.Fprintf(os.Stderr, "USAGE: sfab rotate -i IDENTITY @Y{OLD} @Y{NEW}\n")
+			fmt.Fprintf(os.Stderr, "missing required --identity option!\n")
+			os.Exit(1)
+		}
+
+		old, err := sfab.ParseKeyFromFile(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: @R{%s}\n", args[0], err)
+			os.Exit(3)
+		}
+		if !old.IsPrivateKey() {
+			fmt.Fprintf(os.Stderr, "%s does not contain a private key\n", args[0])
+			os.Exit(2)
+		}
+
+		next, err := sfab.ParseKeyFromFile(args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: @R{%s}\n", args[1], err)
+			os.Exit(3)
+		}
+		if !next.IsPublicKey() {
+			fmt.Fprintf(os.Stderr, "%s does not contain a public key\n", args[1])
+			os.Exit(2)
+		}
+
+		r, err := sfab.NewRotation(opts.Rotate.Identity, old, next)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rotation failed: %s\n", err)
+			os.Exit(2)
+		}
+		fmt.Printf("%s", r.EncodeString())
+		os.Exit(0)
+
 	} else {
 		if command == "" {
 			fmt.Fprintf(os.Stderr, "command `%s' not recognized\n", strings.Join(args, " "))
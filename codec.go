@@ -0,0 +1,102 @@
+package sfab
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// A Codec marshals and unmarshals the arguments and results of RPC
+// calls, for transmission between Hub and Agent.  Both ends of the
+// call must have the same Codec registered (under the same Name).
+//
+// sFAB ships with JSON and gob codecs.  Others can be plugged in via
+// RegisterCodec(); for example, an XML codec built atop the
+// encoding/xml package would look like this:
+//
+//     type xmlCodec struct{}
+//
+//     func (xmlCodec) Name() string { return "xml" }
+//     func (xmlCodec) Marshal(v interface{}) ([]byte, error) { return xml.Marshal(v) }
+//     func (xmlCodec) Unmarshal(b []byte, v interface{}) error { return xml.Unmarshal(b, v) }
+//
+//     sfab.RegisterCodec(xmlCodec{})
+//
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+var (
+	// JSONCodec encodes RPC values as JSON, via encoding/json.
+	// This is the default Codec.
+	//
+	JSONCodec Codec = jsonCodec{}
+
+	// GobCodec encodes RPC values via encoding/gob.
+	//
+	GobCodec Codec = gobCodec{}
+)
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[string]Codec{
+		JSONCodec.Name(): JSONCodec,
+		GobCodec.Name():  GobCodec,
+	}
+)
+
+// RegisterCodec makes a Codec available for decoding RPC calls (on
+// the Agent side), by its Name.  Registering a Codec under a name
+// that is already taken replaces the existing Codec.
+//
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codecs[c.Name()] = c
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+
+	if c, ok := codecs[name]; ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("unrecognized rpc codec '%s'", name)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
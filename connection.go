@@ -1,6 +1,8 @@
 package sfab
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/jhunt/go-log"
@@ -16,6 +18,11 @@ type connection struct {
 	//
 	ssh *ssh.ServerConn
 
+	// The Hub that accepted this connection, for handling
+	// the global requests that the agent sends our way.
+	//
+	hub *Hub
+
 	// The input message channel, which is directly used by
 	// the Hub Send() method to communicate to the goroutine
 	// that is servicing this connection.
@@ -28,7 +35,7 @@ type connection struct {
 	// failures (broken pipes, errors, protocol refusal, etc.)
 	//
 	hangup chan int
-	hungup bool
+	hungup sync.Once
 
 	// Reapers are goroutines (represented by their messaging endpoints)
 	// that have subscribed to the keepalive goroutine, and are interested
@@ -56,6 +63,17 @@ type connection struct {
 	// to send them work to do.
 	//
 	identity string
+
+	// When the agent's (time-bounded) authorization lapses, and
+	// whether or not we have already warned the Hub about it.
+	// These are maintained by the Hub's expiry goroutine.
+	//
+	expiry time.Time
+	warned bool
+
+	// When the agent connected.
+	//
+	since time.Time
 }
 
 // Signal to the machinery of the connection object that it
@@ -68,16 +86,15 @@ type connection struct {
 // cleanup handler to deregister us from the Hub that created
 // us.
 //
-// This method is idempotent - calling it multiple times (so
-// long as they do not interleave) is safe.  Only the first
-// such call will have any effect.
+// This method is idempotent - calling it multiple times (even
+// from different goroutines) is safe.  Only the first such call
+// will have any effect.
 //
 func (c *connection) Hangup() {
-	if !c.hungup {
+	c.hungup.Do(func() {
 		c.hangup <- 0
 		close(c.hangup)
-		c.hungup = false
-	}
+	})
 }
 
 // Monitor the overall health of the underlying TCP connection,
@@ -116,8 +133,9 @@ func (c *connection) monitor(t time.Duration) {
 // Service a nailed up SSH connection from an authenticated
 // (and registered) Agent.  Here's what that entails:
 //
-//   1. Global Requests on the SSH channel are IGNORED.
-//      (this means keepalives too!)
+//   1. Global Requests on the SSH channel are IGNORED,
+//      (this means keepalives too!) except for those that
+//      are part of the sFAB protocol, like key rotation.
 //
 //   2. Requests for new channels (usually sessions) are
 //      rejected; the way sFAB works, we (the server) do
@@ -137,8 +155,8 @@ func (c *connection) monitor(t time.Duration) {
 //      forcefully, to avoid further loss.
 //
 func (c *connection) Serve(chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request, t time.Duration) {
-	go ignoreGlobalRequests(reqs)
-	go ignoreNewChannels(chans)
+	go c.serviceRequests(reqs)
+	go c.serviceChannels(chans)
 	go c.monitor(t)
 
 	for msg := range c.messages {
@@ -149,6 +167,54 @@ func (c *connection) Serve(chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request
 	}
 }
 
+// Handle global requests from the remote Agent, passing
+// those that we understand off to the Hub, and refusing all
+// the others.
+//
+// This method is meant to be called in a goroutine.
+//
+func (c *connection) serviceRequests(in <-chan *ssh.Request) {
+	for r := range in {
+		switch r.Type {
+		case RotationRequestName:
+			/* approval may take a while; don't tie up the
+			   request loop for this connection meanwhile */
+			go func(r *ssh.Request) {
+				if err := c.hub.rotate(c, r.Payload); err != nil {
+					log.Errorf("[hub] key rotation for agent '%s' failed: %s", c.identity, err)
+					r.Reply(false, []byte(err.Error()))
+				} else {
+					r.Reply(true, nil)
+				}
+			}(r)
+
+		case PublishRequestName:
+			if err := c.hub.publish(c, r.Payload); err != nil {
+				log.Errorf("[hub] refusing event from agent '%s': %s", c.identity, err)
+				r.Reply(false, []byte(err.Error()))
+			} else {
+				r.Reply(true, nil)
+			}
+
+		case HostKeysProveRequestName:
+			c.hub.lock()
+			keys := c.hub.hostKeys()
+			c.hub.unlock()
+
+			proof, err := c.prove(keys, r.Payload)
+			if err != nil {
+				log.Errorf("[hub] unable to prove host keys to agent '%s': %s", c.identity, err)
+				r.Reply(false, nil)
+			} else {
+				r.Reply(true, proof)
+			}
+
+		default:
+			r.Reply(false, nil)
+		}
+	}
+}
+
 // Execute a single command on the remote Agent.
 // To do this, we first set up a new SSH session, and
 // then make an "exec" request through it.
@@ -167,7 +233,10 @@ func (c *connection) run(msg Message) error {
 		connection: c,
 		channel:    channel,
 		requests:   requests,
-		exit:       make(chan status),
+		exit:       make(chan status, 1),
+		raw:        msg.raw,
+		stdin:      msg.stdin,
+		ctx:        msg.ctx,
 	}
 	go session.serviceRequests()
 
@@ -181,3 +250,47 @@ func (c *connection) run(msg Message) error {
 	session.finish(msg.responses, reaper)
 	return nil
 }
+
+// Open a new channel (of the given type) to the remote Agent,
+// out-of-band (that is, without waiting for any queued messages),
+// for things like interactive sessions, file transfers and port
+// forwarding.
+//
+// If the context is done before the Agent accepts the channel,
+// the channel is closed as soon as it is accepted.
+//
+func (c *connection) openChannel(ctx context.Context, kind string, extra []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return openChannel(ctx, c.ssh, kind, extra)
+}
+
+// openChannel opens a new channel (of the given type) over an SSH
+// connection, giving up when the context is done.  If that happens
+// before the remote end accepts the channel, the channel is closed
+// as soon as it is accepted.
+//
+func openChannel(ctx context.Context, conn ssh.Conn, kind string, extra []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	type opened struct {
+		channel  ssh.Channel
+		requests <-chan *ssh.Request
+		err      error
+	}
+
+	result := make(chan opened, 1)
+	go func() {
+		channel, requests, err := conn.OpenChannel(kind, extra)
+		result <- opened{channel, requests, err}
+	}()
+
+	select {
+	case o := <-result:
+		return o.channel, o.requests, o.err
+
+	case <-ctx.Done():
+		go func() {
+			if o := <-result; o.err == nil {
+				o.channel.Close()
+			}
+		}()
+		return nil, nil, ctx.Err()
+	}
+}
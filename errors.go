@@ -4,11 +4,37 @@ import (
 	"errors"
 )
 
+// A RemoteError is returned by the Hub's RPC methods, Call() and
+// CallStream(), when the remote method fails.
+//
+type RemoteError struct {
+	// The exit code of the failed RPC execution.
+	//
+	ExitCode int
+
+	// The error message, as reported by the Agent.
+	//
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
 var (
 	AgentNotFoundError      = errors.New("agent not found")
 	AgentNotAuthorizedError = errors.New("agent not authorized")
+
+	UnrecognizedHostKeyError = errors.New("unrecognized host key")
+	HostKeyChangedError      = errors.New("host key changed")
+
+	ChecksumMismatchError = errors.New("checksum mismatch")
 )
 
 func IsAgentNotAvailableError(e error) bool {
 	return e == AgentNotFoundError || e == AgentNotAuthorizedError
 }
+
+func IsHostKeyError(e error) bool {
+	return e == UnrecognizedHostKeyError || e == HostKeyChangedError
+}
@@ -0,0 +1,165 @@
+package sfab
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+)
+
+// The name of the SSH global request that Agents use to publish
+// events to the Hub they are connected to.
+//
+const PublishRequestName = "sfab-publish"
+
+// The wire format of a published event.
+//
+type publishWire struct {
+	Topic   string
+	Payload []byte
+}
+
+// An Event is an unsolicited message, published by an Agent (via its
+// Publish() method) to the Hub it is connected to, and delivered to
+// all of the Hub's matching subscribers.
+//
+type Event struct {
+	// The identity of the (authorized) agent that published
+	// the event.
+	//
+	Agent string
+
+	// The topic the event was published under, i.e. "alerts/disk",
+	// and its opaque payload.
+	//
+	Topic   string
+	Payload []byte
+
+	// When the Hub received the event.
+	//
+	Received time.Time
+}
+
+// A Subscription receives the Events published by agents, whose topics
+// match a glob pattern, as set up by the Hub's Subscribe() method.
+//
+type Subscription struct {
+	// The channel on which matching Events are delivered.  It is
+	// closed when the Subscription is closed.
+	//
+	C <-chan Event
+
+	hub     *Hub
+	pattern string
+	events  chan Event
+	closed  bool
+}
+
+// Publish sends an event to the Hubs that this Agent is currently
+// connected to, under the given topic.  It returns once every Hub has
+// accepted the event for delivery to its subscribers, or with the
+// first error encountered.
+//
+func (a *Agent) Publish(topic string, payload []byte) error {
+	conns := a.connections()
+	if len(conns) == 0 {
+		return fmt.Errorf("not connected to a hub")
+	}
+
+	wire := ssh.Marshal(&publishWire{
+		Topic:   topic,
+		Payload: payload,
+	})
+
+	var failed error
+	for _, hc := range conns {
+		log.Debugf("[agent %s] publishing %d-byte event to topic '%s' on hub %s...", a.Identity, len(payload), topic, hc.host)
+		ok, _, err := hc.conn.SendRequest(PublishRequestName, true, wire)
+		if err == nil && !ok {
+			err = fmt.Errorf("event refused by hub %s", hc.host)
+		}
+		if err != nil && failed == nil {
+			failed = err
+		}
+	}
+	return failed
+}
+
+// Subscribe to Events published by agents, under topics that match
+// the given glob pattern (i.e. "alerts/*"; "*" matches everything).
+// Up to `buffer` Events are queued for the subscriber; if it falls
+// further behind than that, Events are dropped (and logged).
+//
+// The subscriber must Close() the Subscription when it is no longer
+// interested in Events.
+//
+func (h *Hub) Subscribe(pattern string, buffer int) *Subscription {
+	events := make(chan Event, buffer)
+	s := &Subscription{
+		C:       events,
+		hub:     h,
+		pattern: pattern,
+		events:  events,
+	}
+
+	h.lock()
+	h.subscriptions = append(h.subscriptions, s)
+	h.unlock()
+	return s
+}
+
+// Close the Subscription, so that no more Events are delivered to it.
+//
+func (s *Subscription) Close() {
+	s.hub.lock()
+	defer s.hub.unlock()
+
+	if s.closed {
+		return
+	}
+	s.closed = true
+	close(s.events)
+
+	for i, other := range s.hub.subscriptions {
+		if other == s {
+			s.hub.subscriptions = append(s.hub.subscriptions[:i], s.hub.subscriptions[i+1:]...)
+			break
+		}
+	}
+}
+
+// publish delivers an Event, published by an agent, to all matching
+// subscribers, without blocking.
+//
+func (h *Hub) publish(c *connection, payload []byte) error {
+	if !h.keys.Authorized(c.identity, c.key) {
+		return fmt.Errorf("agent not authorized")
+	}
+
+	var w publishWire
+	if err := ssh.Unmarshal(payload, &w); err != nil {
+		return fmt.Errorf("malformed event: %s", err)
+	}
+
+	ev := Event{
+		Agent:    c.identity,
+		Topic:    w.Topic,
+		Payload:  w.Payload,
+		Received: time.Now(),
+	}
+
+	h.lock()
+	defer h.unlock()
+	for _, s := range h.subscriptions {
+		if !glob(s.pattern, ev.Topic) {
+			continue
+		}
+		select {
+		case s.events <- ev:
+		default:
+			log.Errorf("[hub] dropping event '%s' from agent '%s'; subscriber for '%s' is not keeping up", ev.Topic, ev.Agent, s.pattern)
+		}
+	}
+	return nil
+}
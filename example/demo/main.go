@@ -165,8 +165,11 @@ func main() {
 			PrivateKey: key,
 		}
 
+		mux := &sfab.Mux{}
+		mux.Handle("ping", ping)
+
 		fmt.Fprintf(os.Stderr, "@Y{demo agent} connecting to hub at @M{%s}\n", opts.Agent.Hub)
-		err = a.Connect("tcp4", opts.Agent.Hub, jsonnet)
+		err = a.ConnectStream("tcp4", opts.Agent.Hub, mux.Dispatch)
 		bail(err, "unable to connect to hub at '%s'", opts.Agent.Hub)
 		os.Exit(0)
 
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -50,19 +51,13 @@ func bail(err error, msg string, args ...interface{}) {
 	}
 }
 
-func jsonnet(cmd []byte, stdout io.Writer, stderr io.Writer) (int, error) {
-	fmt.Fprintf(stderr, "debug:: unmarshaling payload [%s]...\n", string(cmd))
-	fmt.Fprintf(stderr, "debug::   if you prefer hex: [% x]...\n", cmd)
-
+func ping(ctx context.Context, cmd []byte, stdin io.Reader, stdout io.Writer, stderr io.Writer) (int, error) {
 	write := func(f string, args ...interface{}) {
 		fmt.Fprintf(stdout, f, args...)
 		fmt.Fprintf(os.Stderr, f, args...)
 	}
 
-	if string(cmd) == "ping" {
-		write("PONG,%s", time.Now())
-		fmt.Printf("PING  at time: %s\n", time.Now())
-	}
-
+	write("PONG,%s", time.Now())
+	fmt.Printf("PING  at time: %s\n", time.Now())
 	return 0, nil
 }
@@ -0,0 +1,304 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-log"
+)
+
+// DefaultFailbackInterval will be used as a fallback, should an Agent
+// not set its FailbackInterval attribute, for ConnectFailover() and
+// ConnectSRV().
+//
+const DefaultFailbackInterval time.Duration = 30 * time.Second
+
+// The DNS SRV service name that ConnectSRV() looks up, as in
+// _sfab._tcp.example.com.
+//
+const SRVService = "sfab"
+
+// A Resolver looks up DNS SRV records.  The standard library's
+// *net.Resolver (and net.DefaultResolver) satisfy this interface.
+//
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// ConnectFailover connects to the first Hub in the given list that
+// will have it, and responds to execution requests from that Hub with
+// the passed Handler.  If the connection fails (or cannot be made),
+// the Agent moves on to the next Hub in the list, starting over from
+// the top once the list is exhausted (after ReconnectInterval).
+//
+// While connected to anything but the first Hub, the Agent checks
+// (every FailbackInterval) whether a Hub earlier in the list will
+// accept it again (by connecting and authenticating to it); if so, it
+// hangs up on the current Hub (interrupting anything it is running)
+// and fails back, starting over from the top of the list right away.
+//
+// Like ConnectAll(), this method blocks until the context is done
+// (returning its error), or until the Handler asks for the Agent to
+// terminate (returning nil).
+//
+func (a *Agent) ConnectFailover(ctx context.Context, hubs []string, handler StreamHandler) error {
+	if len(hubs) == 0 {
+		return fmt.Errorf("no hubs to connect to")
+	}
+	return a.failover(ctx, func(context.Context) ([]string, error) {
+		return hubs, nil
+	}, handler)
+}
+
+// ConnectSRV discovers the Hubs to connect to via the DNS SRV records
+// for the given domain (i.e. _sfab._tcp.example.com, for example.com),
+// and then connects to them in order of priority (choosing randomly,
+// according to weight, among Hubs of the same priority), with the
+// same failover (and failback) behavior as ConnectFailover().
+//
+// The SRV records are looked up again each time the Agent starts over
+// from the top of the list, using the Agent's Resolver (or the system
+// resolver, if it does not have one).
+//
+func (a *Agent) ConnectSRV(ctx context.Context, domain string, handler StreamHandler) error {
+	resolver := a.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return a.failover(ctx, func(ctx context.Context) ([]string, error) {
+		_, records, err := resolver.LookupSRV(ctx, SRVService, "tcp", domain)
+		if err != nil {
+			return nil, err
+		}
+		hubs := orderSRV(records)
+		if len(hubs) == 0 {
+			return nil, fmt.Errorf("no hubs found for %s", domain)
+		}
+		log.Debugf("[agent %s] discovered hubs %s via SRV records for %s", a.Identity, strings.Join(hubs, ", "), domain)
+		return hubs, nil
+	}, handler)
+}
+
+// failover implements ConnectFailover() and ConnectSRV(), given a
+// function for (re-)determining the ordered list of Hubs.
+//
+func (a *Agent) failover(ctx context.Context, resolve func(context.Context) ([]string, error), handler StreamHandler) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+
+	interval := a.ReconnectInterval
+	if interval == 0 {
+		interval = DefaultReconnectInterval
+	}
+	handler = a.rpc(handler)
+
+	for {
+		hubs, err := resolve(ctx)
+		if err != nil {
+			log.Errorf("[agent %s] unable to determine which hubs to connect to: %s", a.Identity, err)
+		}
+
+		var link *hubLink
+		for i := 0; i < len(hubs); i++ {
+			hub := hubs[i]
+			halted, err := a.connectPreferring(ctx, hub, hubs[:i], link, handler)
+			link = nil
+			if halted {
+				return nil
+			}
+			if fb, ok := err.(*failback); ok {
+				if ctx.Err() != nil {
+					fb.link.conn.Close()
+					return ctx.Err()
+				}
+				/* pick up right where the probe left off */
+				i, link = fb.index-1, fb.link
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil {
+				log.Errorf("[agent %s] unable to connect to hub %s: %s", a.Identity, hub, err)
+			} else {
+				log.Infof("[agent %s] lost connection to hub %s", a.Identity, hub)
+			}
+		}
+
+		log.Debugf("[agent %s] starting over from the first hub in %s...", a.Identity, interval)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// A failback is what connectPreferring() returns (as an error) when
+// one of the preferred Hubs will have us again, along with the SSH
+// connection we made to that Hub to find that out.
+//
+type failback struct {
+	index int
+	link  *hubLink
+}
+
+func (f *failback) Error() string {
+	return "failing back to a preferred hub"
+}
+
+// connectPreferring connects to a Hub (or resumes an already-made SSH
+// connection to it), but hangs up (returning a *failback) as soon as
+// any of the preferred Hubs will have us again.
+//
+func (a *Agent) connectPreferring(ctx context.Context, hub string, preferred []string, link *hubLink, handler StreamHandler) (bool, error) {
+	if len(preferred) == 0 {
+		return a.resume(ctx, "tcp", hub, link, handler)
+	}
+
+	every := a.FailbackInterval
+	if every == 0 {
+		every = DefaultFailbackInterval
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var fb *failback
+	probing := make(chan struct{})
+	go func() {
+		defer close(probing)
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			for i, p := range preferred {
+				if link := a.probe(ctx, p, every); link != nil {
+					log.Infof("[agent %s] preferred hub %s is back; failing back from hub %s", a.Identity, p, hub)
+					fb = &failback{index: i, link: link}
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	halted, err := a.resume(ctx, "tcp", hub, link, handler)
+
+	/* don't leave a probe (or the connection it made) dangling */
+	cancel()
+	<-probing
+
+	if fb != nil {
+		if halted {
+			fb.link.conn.Close()
+			return true, err
+		}
+		return false, fb
+	}
+	return halted, err
+}
+
+// probe checks whether a Hub will have us, by connecting to it and
+// going through the SSH handshake (host key checks, authentication,
+// and all).  A Hub that merely accepts TCP connections, but turns us
+// away, is no reason to fail back.  The handshake must finish within
+// the given timeout.
+//
+// If the Hub does take us, the resulting connection is returned, so
+// that the Agent can fail back over it; otherwise, probe returns nil.
+//
+func (a *Agent) probe(ctx context.Context, hub string, timeout time.Duration) *hubLink {
+	dctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	socket, err := a.dial(dctx, "tcp", hub)
+	if err != nil {
+		return nil
+	}
+
+	socket.SetDeadline(time.Now().Add(timeout))
+	link, err := a.handshake(hub, socket)
+	if err != nil {
+		log.Debugf("[agent %s] preferred hub %s is accepting connections, but not ours: %s", a.Identity, hub, err)
+		return nil
+	}
+	socket.SetDeadline(time.Time{})
+	return link
+}
+
+// orderSRV orders a set of SRV records per RFC-2782: by priority, and
+// then, within each priority, by a random selection weighted by the
+// records' weights.  Records whose target is "." (meaning that the
+// service is decidedly not available) are dropped.
+//
+func orderSRV(records []*net.SRV) []string {
+	l := make([]*net.SRV, 0, len(records))
+	for _, r := range records {
+		if r.Target != "." && r.Target != "" {
+			l = append(l, r)
+		}
+	}
+	sort.SliceStable(l, func(i, j int) bool {
+		return l[i].Priority < l[j].Priority
+	})
+
+	hubs := make([]string, 0, len(l))
+	for i := 0; i < len(l); {
+		j := i
+		for j < len(l) && l[j].Priority == l[i].Priority {
+			j++
+		}
+		for _, r := range weighted(l[i:j]) {
+			hubs = append(hubs, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+		}
+		i = j
+	}
+	return hubs
+}
+
+// weighted shuffles a set of SRV records (of the same priority),
+// choosing each next record at random, in proportion to its weight.
+// Records with zero weight have a small chance of being chosen early.
+//
+func weighted(l []*net.SRV) []*net.SRV {
+	l = append([]*net.SRV{}, l...)
+	out := make([]*net.SRV, 0, len(l))
+	for len(l) > 0 {
+		total := 0
+		for _, r := range l {
+			total += int(r.Weight)
+		}
+
+		pick := 0
+		if total > 0 {
+			n := rand.Intn(total + 1)
+			for i, r := range l {
+				n -= int(r.Weight)
+				if n <= 0 {
+					pick = i
+					break
+				}
+			}
+		} else {
+			pick = rand.Intn(len(l))
+		}
+
+		out = append(out, l[pick])
+		l = append(l[:pick], l[pick+1:]...)
+	}
+	return out
+}
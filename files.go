@@ -0,0 +1,680 @@
+package sfab
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+)
+
+// FileSubsystem is the name of the SSH subsystem that Agents serve
+// file transfers on, if they have any FileRoots configured.
+//
+const FileSubsystem = "sfab-files"
+
+// While a file is being pushed to an Agent, it is written to a
+// partial file (alongside its final destination), which is only
+// renamed into place once its checksum has been verified.  Partial
+// files are what make interrupted pushes resumable.
+//
+const partialFileSuffix = ".sfab-part"
+
+// The longest request or reply line we are willing to read.
+//
+const maxFileHeader = 8192
+
+// Progress describes how far along a file transfer is, as reported
+// to the Hub's OnProgress callback.
+//
+type Progress struct {
+	// The agent that the file is being transferred to (or from),
+	// and the path of the file on that agent.
+	//
+	Agent string
+	Path  string
+
+	// Either "push" (hub to agent) or "pull" (agent to hub).
+	//
+	Direction string
+
+	// How many bytes of the file have been transferred so far,
+	// including any bytes transferred by a previous (interrupted)
+	// attempt, and the total size of the file, or -1 if it is
+	// not known.
+	//
+	Bytes int64
+	Total int64
+}
+
+// A ProgressCallback is called periodically during a file transfer,
+// after each chunk has been sent (or received).
+//
+type ProgressCallback func(Progress)
+
+// PushFile copies the contents of a local reader to a file (by path)
+// on an agent (by name), creating it with the given mode.  The agent
+// must have a FileRoots directory that contains the remote path.
+//
+// The file is checksummed (via SHA-256) on both ends, and is only put
+// in place once the checksums match.  If the reader is also seekable
+// (i.e. an *os.File), an interrupted push can be resumed by pushing
+// the same file again; the parts the agent already has are skipped.
+//
+// If the context is cancelled, the transfer is aborted.
+//
+func (h *Hub) PushFile(ctx context.Context, agent string, r io.Reader, remotePath string, mode os.FileMode) error {
+	ch, done, err := h.openFiles(ctx, agent)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	fail := func(err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	in := bufio.NewReaderSize(ch, maxFileHeader)
+	if _, err := fmt.Fprintf(ch, "push %o %s\n", mode.Perm(), remotePath); err != nil {
+		return fail(err)
+	}
+	l, err := fileReply(in, agent, 2)
+	if err != nil {
+		return fail(err)
+	}
+	partial, err := strconv.ParseInt(l[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("malformed reply from agent '%s': %s", agent, err)
+	}
+
+	var (
+		offset int64
+		total  int64 = -1
+		sum          = sha256.New()
+	)
+	if seeker, ok := r.(io.Seeker); ok {
+		if total, err = seeker.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		if partial > 0 && partial <= total {
+			if _, err := io.CopyN(sum, r, partial); err != nil {
+				return err
+			}
+			if hex.EncodeToString(sum.Sum(nil)) == l[1] {
+				log.Infof("[hub] resuming push of %s to agent '%s' at byte %d", remotePath, agent, partial)
+				offset = partial
+			} else {
+				sum.Reset()
+				if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if _, err := fmt.Fprintf(ch, "%d\n", offset); err != nil {
+		return fail(err)
+	}
+	n, err := writeChunks(ch, r, sum, h.progress(agent, remotePath, "push", offset, total))
+	if err != nil {
+		return fail(err)
+	}
+	if err := ch.CloseWrite(); err != nil {
+		return fail(err)
+	}
+
+	if l, err = fileReply(in, agent, 2); err != nil {
+		return fail(err)
+	}
+	if l[1] != hex.EncodeToString(sum.Sum(nil)) {
+		return ChecksumMismatchError
+	}
+
+	log.Infof("[hub] pushed %s (%d bytes) to agent '%s'", remotePath, offset+n, agent)
+	return nil
+}
+
+// PullFile copies the contents of a file (by path) on an agent (by
+// name) to a local writer.  The agent must have a FileRoots directory
+// that contains the remote path.
+//
+// The file is checksummed (via SHA-256) on both ends; if the checksums
+// do not match, ChecksumMismatchError is returned.  If the writer is
+// an *os.File (or anything else that can be read, seeked and truncated)
+// that already has some of the remote file in it, the pull resumes
+// where the last one left off.
+//
+// If the context is cancelled, the transfer is aborted.
+//
+func (h *Hub) PullFile(ctx context.Context, agent string, remotePath string, w io.Writer) error {
+	ch, done, err := h.openFiles(ctx, agent)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	fail := func(err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	var (
+		offset int64
+		prefix = "-"
+		sum    = sha256.New()
+	)
+	f, resumable := w.(resumableFile)
+	if resumable {
+		if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+		if offset > 0 {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(sum, f, offset); err != nil {
+				return err
+			}
+			prefix = hex.EncodeToString(sum.Sum(nil))
+		}
+	}
+
+	in := bufio.NewReaderSize(ch, maxFileHeader)
+	if _, err := fmt.Fprintf(ch, "pull %d %s %s\n", offset, prefix, remotePath); err != nil {
+		return fail(err)
+	}
+	l, err := fileReply(in, agent, 2)
+	if err != nil {
+		return fail(err)
+	}
+	total, err1 := strconv.ParseInt(l[0], 10, 64)
+	start, err2 := strconv.ParseInt(l[1], 10, 64)
+	if err1 != nil || err2 != nil || (start != 0 && start != offset) {
+		return fmt.Errorf("malformed reply from agent '%s'", agent)
+	}
+
+	if start != offset {
+		sum.Reset()
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	} else if offset > 0 {
+		log.Infof("[hub] resuming pull of %s from agent '%s' at byte %d", remotePath, agent, offset)
+	}
+
+	n, trailer, err := readChunks(in, w, sum, h.progress(agent, remotePath, "pull", start, total))
+	if err != nil {
+		return fail(err)
+	}
+	if !bytes.Equal(trailer, sum.Sum(nil)) {
+		return ChecksumMismatchError
+	}
+
+	log.Infof("[hub] pulled %s (%d bytes) from agent '%s'", remotePath, start+n, agent)
+	return nil
+}
+
+// A resumableFile is a local destination for PullFile() that can pick
+// up where a previous (interrupted) pull left off.
+//
+type resumableFile interface {
+	io.ReadWriteSeeker
+	Truncate(int64) error
+}
+
+// openFiles opens a session channel to an agent (by name), and starts
+// up the file transfer subsystem on it.  The returned function must
+// be called to close the channel, once the transfer is complete.
+//
+func (h *Hub) openFiles(ctx context.Context, agent string) (ssh.Channel, func(), error) {
+	c, err := h.connected(agent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch, requests, err := c.openChannel(ctx, "session", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	go ssh.DiscardRequests(requests)
+
+	ok, err := ch.SendRequest("subsystem", true, ssh.Marshal(&struct{ Name string }{FileSubsystem}))
+	if err == nil && !ok {
+		err = fmt.Errorf("agent '%s' does not allow file transfers", agent)
+	}
+	if err != nil {
+		ch.Close()
+		return nil, nil, err
+	}
+
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			ch.Close()
+		case <-stop:
+		}
+	}()
+
+	return ch, func() {
+		close(stop)
+		ch.Close()
+	}, nil
+}
+
+// progress returns a function for writeChunks() / readChunks() to
+// call as they go, which passes the progress of a transfer on to the
+// Hub's OnProgress callback, if it has one.
+//
+func (h *Hub) progress(agent, path, direction string, offset, total int64) func(int64) {
+	if h.OnProgress == nil {
+		return nil
+	}
+	return func(n int64) {
+		h.OnProgress(Progress{
+			Agent:     agent,
+			Path:      path,
+			Direction: direction,
+			Bytes:     offset + n,
+			Total:     total,
+		})
+	}
+}
+
+// fileReply reads a single reply line from the agent, which is either
+// "ok", followed by (at least) n fields, or "error", followed by an
+// error message.
+//
+func fileReply(in *bufio.Reader, agent string, n int) ([]string, error) {
+	line, err := readLine(in)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(line, "error ") {
+		return nil, fmt.Errorf("agent '%s' failed the file transfer: %s", agent, strings.TrimPrefix(line, "error "))
+	}
+	l := strings.Fields(line)
+	if len(l) < n+1 || l[0] != "ok" {
+		return nil, fmt.Errorf("malformed reply from agent '%s'", agent)
+	}
+	return l[1:], nil
+}
+
+// readLine reads a single newline-terminated line, without the newline,
+// refusing to read more than maxFileHeader bytes.
+//
+func readLine(in *bufio.Reader) (string, error) {
+	line, err := in.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(line), "\n"), nil
+}
+
+// The chunked transfer encoding used by the file transfer subsystem
+// frames each chunk of data with its length, as a 32-bit big-endian
+// integer.  A zero-length chunk marks the end of the data, and is
+// followed by the SHA-256 checksum of the entire file.  A transfer
+// that ends without that trailer was interrupted.
+//
+
+// writeChunks copies the contents of a reader as a series of chunks,
+// followed by the checksum trailer, returning the number of bytes of
+// data copied.
+//
+func writeChunks(out io.Writer, in io.Reader, sum hash.Hash, progress func(int64)) (int64, error) {
+	var (
+		n   int64
+		buf = make([]byte, 4+rawChunkSize)
+	)
+	for {
+		m, err := in.Read(buf[4:])
+		if m > 0 {
+			binary.BigEndian.PutUint32(buf[:4], uint32(m))
+			if _, err := out.Write(buf[:4+m]); err != nil {
+				return n, err
+			}
+			sum.Write(buf[4 : 4+m])
+			n += int64(m)
+			if progress != nil {
+				progress(n)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+
+	binary.BigEndian.PutUint32(buf[:4], 0)
+	_, err := out.Write(append(buf[:4], sum.Sum(nil)...))
+	return n, err
+}
+
+// readChunks copies a series of chunks to a writer, returning the
+// number of bytes of data copied, and the checksum trailer.
+//
+func readChunks(in io.Reader, out io.Writer, sum hash.Hash, progress func(int64)) (int64, []byte, error) {
+	var (
+		n   int64
+		hdr [4]byte
+	)
+	for {
+		if _, err := io.ReadFull(in, hdr[:]); err != nil {
+			return n, nil, fmt.Errorf("file transfer interrupted: %s", err)
+		}
+
+		m := binary.BigEndian.Uint32(hdr[:])
+		if m == 0 {
+			trailer := make([]byte, sha256.Size)
+			if _, err := io.ReadFull(in, trailer); err != nil {
+				return n, nil, fmt.Errorf("file transfer interrupted: %s", err)
+			}
+			return n, trailer, nil
+		}
+		if m > rawChunkSize {
+			return n, nil, fmt.Errorf("file transfer chunk too large (%d bytes)", m)
+		}
+
+		if _, err := io.CopyN(io.MultiWriter(out, sum), in, int64(m)); err != nil {
+			return n, nil, fmt.Errorf("file transfer interrupted: %s", err)
+		}
+		n += int64(m)
+		if progress != nil {
+			progress(n)
+		}
+	}
+}
+
+// serveFiles services the file transfer subsystem on a session channel,
+// handling a single push or pull request, before closing the channel.
+//
+// This method is meant to be called in a goroutine.
+//
+func (a *Agent) serveFiles(hub string, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	in := bufio.NewReaderSize(ch, maxFileHeader)
+	line, err := readLine(in)
+	if err != nil {
+		log.Errorf("[agent %s] unable to read file transfer request from hub: %s", a.Identity, err)
+		return
+	}
+
+	l := strings.SplitN(line, " ", 2)
+	switch {
+	case l[0] == "push" && len(l) == 2:
+		err = a.receiveFile(hub, ch, in, l[1])
+	case l[0] == "pull" && len(l) == 2:
+		err = a.sendFile(hub, ch, l[1])
+	default:
+		err = fmt.Errorf("unrecognized file transfer request")
+	}
+
+	if err != nil {
+		log.Errorf("[agent %s] file transfer failed: %s", a.Identity, err)
+		fmt.Fprintf(ch, "error %s\n", strings.Replace(err.Error(), "\n", " ", -1))
+	}
+}
+
+// receiveFile handles a push from the Hub, of the form:
+//
+//     push <mode> <path>
+//
+// replying with the size and checksum of any partial file left over
+// from an earlier push, so that the Hub can resume from there.
+//
+func (a *Agent) receiveFile(hub string, ch ssh.Channel, in *bufio.Reader, args string) error {
+	l := strings.SplitN(args, " ", 2)
+	if len(l) != 2 {
+		return fmt.Errorf("malformed push request")
+	}
+	mode, err := strconv.ParseUint(l[0], 8, 32)
+	if err != nil {
+		return fmt.Errorf("malformed push request: %s", err)
+	}
+	path, err := a.confine(l[1])
+	if err != nil {
+		return err
+	}
+	part, err := a.confine(path + partialFileSuffix)
+	if err != nil {
+		return err
+	}
+
+	size, sum, err := checksum(part)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fmt.Fprintf(ch, "ok %d %s\n", size, hex.EncodeToString(sum.Sum(nil)))
+
+	line, err := readLine(in)
+	if err != nil {
+		return err
+	}
+	offset, err := strconv.ParseInt(line, 10, 64)
+	if err != nil || (offset != 0 && offset != size) {
+		return fmt.Errorf("malformed push offset")
+	}
+	if offset == 0 {
+		sum.Reset()
+	}
+
+	f, err := openPart(part)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	n, trailer, err := readChunks(in, f, sum, nil)
+	if err != nil {
+		/* leave the partial file, for the Hub to resume */
+		f.Close()
+		a.audit(hub, "file-push", "push of %s interrupted after %d bytes", path, offset+n)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if !bytes.Equal(trailer, sum.Sum(nil)) {
+		os.Remove(part)
+		a.audit(hub, "file-push", "push of %s failed checksum verification", path)
+		return ChecksumMismatchError
+	}
+	if err := os.Chmod(part, os.FileMode(mode)); err != nil {
+		return err
+	}
+	if err := os.Rename(part, path); err != nil {
+		return err
+	}
+
+	a.audit(hub, "file-push", "received %s (%d bytes, mode %04o, sha256 %x)", path, offset+n, mode, trailer)
+	fmt.Fprintf(ch, "ok %d %x\n", offset+n, trailer)
+	return nil
+}
+
+// sendFile handles a pull from the Hub, of the form:
+//
+//     pull <offset> <prefix-sha256> <path>
+//
+// resuming from the given offset if the first that many bytes of the
+// file still match the checksum the Hub has for them.
+//
+func (a *Agent) sendFile(hub string, ch ssh.Channel, args string) error {
+	l := strings.SplitN(args, " ", 3)
+	if len(l) != 3 {
+		return fmt.Errorf("malformed pull request")
+	}
+	offset, err := strconv.ParseInt(l[0], 10, 64)
+	if err != nil || offset < 0 {
+		return fmt.Errorf("malformed pull offset")
+	}
+	path, err := a.confine(l[2])
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", path)
+	}
+
+	var start int64
+	sum := sha256.New()
+	if offset > 0 && offset <= st.Size() {
+		if _, err := io.CopyN(sum, f, offset); err != nil {
+			return err
+		}
+		if hex.EncodeToString(sum.Sum(nil)) == l[1] {
+			start = offset
+		} else {
+			sum.Reset()
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Fprintf(ch, "ok %d %d\n", st.Size(), start)
+	n, err := writeChunks(ch, f, sum, nil)
+	if err != nil {
+		/* the channel is no good for reporting errors anymore */
+		a.audit(hub, "file-pull", "pull of %s interrupted after %d bytes", path, start+n)
+		return nil
+	}
+
+	a.audit(hub, "file-pull", "sent %s (%d bytes, starting at %d, sha256 %x)", path, start+n, start, sum.Sum(nil))
+	return nil
+}
+
+// checksum calculates the size and SHA-256 checksum of a file.
+//
+func checksum(path string) (int64, hash.Hash, error) {
+	sum := sha256.New()
+	if st, err := os.Lstat(path); err != nil {
+		return 0, sum, err
+	} else if !st.Mode().IsRegular() {
+		return 0, sum, fmt.Errorf("%s: not a regular file", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, sum, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(sum, f)
+	return n, sum, err
+}
+
+// openPart opens a partial file for writing, without following a
+// symbolic link (or anything else that isn't a regular file) that
+// someone else may have left in its place.  New partial files are
+// created exclusively; existing ones must still be the same file
+// that we checked, once opened.
+//
+func openPart(path string) (*os.File, error) {
+	st, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !st.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: not a regular file", path)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if fst, err := f.Stat(); err != nil || !os.SameFile(st, fst) {
+		f.Close()
+		return nil, fmt.Errorf("%s: changed while opening it", path)
+	}
+	return f, nil
+}
+
+// confine resolves a path requested by the Hub, ensuring that it lies
+// within one of the Agent's FileRoots (even after following symbolic
+// links in its parent directories).
+//
+func (a *Agent) confine(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("%s: not an absolute path", path)
+	}
+	path = filepath.Clean(path)
+
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", path, err)
+	}
+	resolved := filepath.Join(dir, filepath.Base(path))
+
+	for _, root := range a.FileRoots {
+		root, err := filepath.EvalSymlinks(filepath.Clean(root))
+		if err != nil {
+			continue
+		}
+		if within(root, resolved) {
+			if st, err := os.Lstat(resolved); err == nil && st.Mode()&os.ModeSymlink != 0 {
+				return "", fmt.Errorf("%s: refusing to follow symbolic link", path)
+			}
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("%s: outside of the agent's file roots", path)
+}
+
+// within returns true if path is strictly inside of the root directory.
+//
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,411 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+)
+
+// The wire format of a "direct-tcpip" channel open request, per
+// section 7.2 of RFC-4254.
+//
+type directTCPIP struct {
+	Host           string
+	Port           uint32
+	OriginatorIP   string
+	OriginatorPort uint32
+}
+
+// Dial opens a TCP connection to the given address, from (and in the
+// network of) an agent (by name), tunnelled through that agent's SSH
+// connection to the Hub.  The network must be "tcp", "tcp4" or "tcp6";
+// the address is resolved by the agent, not the Hub.
+//
+// The agent must allow connections to the address, via its ForwardTo
+// list.  The context governs how long to wait for the connection to
+// be established; once it is, the caller must Close() it.
+//
+func (h *Hub) Dial(ctx context.Context, agent, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("unsupported network '%s' (only tcp is supported)", network)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port '%s'", port)
+	}
+
+	c, err := h.connected(agent)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, requests, err := c.openChannel(ctx, "direct-tcpip", ssh.Marshal(&directTCPIP{
+		Host:         host,
+		Port:         uint32(n),
+		OriginatorIP: "127.0.0.1",
+	}))
+	if err != nil {
+		if oc, ok := err.(*ssh.OpenChannelError); ok {
+			return nil, fmt.Errorf("agent '%s' refused to forward to %s: %s", agent, address, oc.Message)
+		}
+		return nil, err
+	}
+	go ssh.DiscardRequests(requests)
+
+	log.Infof("[hub] forwarding to %s through agent '%s'", address, agent)
+	return newForwardedConn(ch,
+		forwardAddr{network: network, address: "agent:" + agent},
+		forwardAddr{network: network, address: address}), nil
+}
+
+// A forwardedConn is a net.Conn that is tunnelled through an agent,
+// over a "direct-tcpip" SSH channel.
+//
+// SSH channels have no notion of deadlines, so reads are done in the
+// background, and handed off to Read(), which can stop waiting on them
+// when its deadline passes.  Likewise, a Write() that is still blocked
+// (on the channel's flow control window) when its deadline passes
+// returns a timeout error, but the data it was given is still sent,
+// in order, ahead of anything written later.
+//
+type forwardedConn struct {
+	ssh.Channel
+	local, remote net.Addr
+
+	rd, wd *deadline
+
+	rlk     sync.Mutex
+	pumping sync.Once
+	reads   chan forwardedRead
+	pending []byte
+	rerr    error
+
+	writing chan struct{}
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type forwardedRead struct {
+	data []byte
+	err  error
+}
+
+func newForwardedConn(ch ssh.Channel, local, remote net.Addr) *forwardedConn {
+	return &forwardedConn{
+		Channel: ch,
+		local:   local,
+		remote:  remote,
+		rd:      newDeadline(),
+		wd:      newDeadline(),
+		reads:   make(chan forwardedRead),
+		writing: make(chan struct{}, 1),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *forwardedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *forwardedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *forwardedConn) Read(b []byte) (int, error) {
+	c.rlk.Lock()
+	defer c.rlk.Unlock()
+
+	if len(c.pending) == 0 {
+		if c.rerr != nil {
+			return 0, c.rerr
+		}
+
+		select {
+		case <-c.rd.wait():
+			return 0, timeoutError{}
+		default:
+		}
+
+		c.pumping.Do(func() {
+			go c.pump()
+		})
+		select {
+		case r := <-c.reads:
+			c.pending, c.rerr = r.data, r.err
+			if len(c.pending) == 0 {
+				return 0, c.rerr
+			}
+		case <-c.rd.wait():
+			return 0, timeoutError{}
+		case <-c.closed:
+			return 0, io.ErrClosedPipe
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// pump reads from the underlying channel, handing each chunk off to
+// Read(), until the channel fails or the connection is closed.
+//
+func (c *forwardedConn) pump() {
+	for {
+		b := make([]byte, 32*1024)
+		n, err := c.Channel.Read(b)
+		select {
+		case c.reads <- forwardedRead{data: b[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *forwardedConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.wd.wait():
+		return 0, timeoutError{}
+	default:
+	}
+
+	/* wait for any earlier (abandoned) write to finish */
+	select {
+	case c.writing <- struct{}{}:
+	case <-c.wd.wait():
+		return 0, timeoutError{}
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	}
+
+	/* the caller may reuse b as soon as we return */
+	b = append([]byte(nil), b...)
+	done := make(chan forwardedRead, 1)
+	go func() {
+		n, err := c.Channel.Write(b)
+		<-c.writing
+		done <- forwardedRead{data: b[:n], err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return len(r.data), r.err
+	case <-c.wd.wait():
+		return 0, timeoutError{}
+	}
+}
+
+func (c *forwardedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Channel.Close()
+}
+
+func (c *forwardedConn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return nil
+}
+
+func (c *forwardedConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+func (c *forwardedConn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return nil
+}
+
+// A deadline is a point in time, after which its wait() channel is
+// closed, until the deadline is moved (or cleared).
+//
+type deadline struct {
+	lk      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{expired: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		/* the timer fired; wait for it to close the channel */
+		<-d.expired
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.expired:
+		closed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		return
+	}
+
+	if wait := time.Until(t); wait > 0 {
+		if closed {
+			d.expired = make(chan struct{})
+		}
+		expired := d.expired
+		d.timer = time.AfterFunc(wait, func() {
+			close(expired)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.expired)
+	}
+}
+
+func (d *deadline) wait() <-chan struct{} {
+	d.lk.Lock()
+	defer d.lk.Unlock()
+	return d.expired
+}
+
+// A timeoutError is returned by reads and writes on a forwarded
+// connection that run past their deadline.
+//
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// A forwardAddr is the (unresolved) address of either end of a
+// forwarded connection.
+//
+type forwardAddr struct {
+	network string
+	address string
+}
+
+func (a forwardAddr) Network() string {
+	return a.network
+}
+
+func (a forwardAddr) String() string {
+	return a.address
+}
+
+// forward handles a "direct-tcpip" channel from the Hub, connecting
+// to the requested destination (if it is allowed by the Agent's
+// ForwardTo list), and shuttling bytes in both directions until
+// either side hangs up.
+//
+// This method is meant to be called in a goroutine.
+//
+func (a *Agent) forward(hub string, newch ssh.NewChannel) {
+	var req directTCPIP
+	if err := ssh.Unmarshal(newch.ExtraData(), &req); err != nil {
+		log.Errorf("[agent %s] unable to unmarshal forwarding request from upstream hub: %s", a.Identity, err)
+		newch.Reject(ssh.ConnectionFailed, "malformed request")
+		return
+	}
+
+	dest := net.JoinHostPort(req.Host, strconv.FormatUint(uint64(req.Port), 10))
+	if !a.forwardable(req.Host, req.Port) {
+		a.audit(hub, "forward-denied", "refused to forward to %s", dest)
+		newch.Reject(ssh.Prohibited, "destination not allowed")
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", dest, a.Timeout)
+	if err != nil {
+		a.audit(hub, "forward-failed", "unable to forward to %s: %s", dest, err)
+		newch.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	ch, reqs, err := newch.Accept()
+	if err != nil {
+		log.Errorf("[agent %s] failed to accept new '%s' channel: %s", a.Identity, newch.ChannelType(), err)
+		return
+	}
+	defer ch.Close()
+	go ssh.DiscardRequests(reqs)
+
+	a.audit(hub, "forward-open", "forwarding to %s (%s)", dest, conn.RemoteAddr())
+	start := time.Now()
+
+	var (
+		wg      sync.WaitGroup
+		in, out int64
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		in, _ = io.Copy(conn, ch)
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		out, _ = io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	wg.Wait()
+
+	a.audit(hub, "forward-close", "forward to %s closed after %s (%d bytes in, %d bytes out)", dest, time.Since(start), in, out)
+}
+
+// forwardable checks a destination against the Agent's ForwardTo list,
+// and (for loopback destinations) its ExposePorts.
+//
+func (a *Agent) forwardable(host string, port uint32) bool {
+	if host == "127.0.0.1" || host == "::1" || host == "localhost" {
+		for _, exposed := range a.ExposePorts {
+			if uint32(exposed) == port {
+				return true
+			}
+		}
+	}
+
+	for _, allowed := range a.ForwardTo {
+		h, p, err := net.SplitHostPort(allowed)
+		if err != nil {
+			continue
+		}
+		if p != "*" && p != strconv.FormatUint(uint64(port), 10) {
+			continue
+		}
+		if h == host || (isPattern(h) && matchSubject(h, host)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,180 @@
+package sfab
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+)
+
+// The OpenSSH host key rotation extension names; see section 2.5
+// of the OpenSSH PROTOCOL document for the gory details.
+//
+const (
+	HostKeysRequestName      = "hostkeys-00@openssh.com"
+	HostKeysProveRequestName = "hostkeys-prove-00@openssh.com"
+)
+
+// Encode a list of public keys as a sequence of SSH strings, which
+// is the payload format of both hostkeys requests.
+//
+func marshalKeyBlobs(keys []ssh.PublicKey) []byte {
+	var b []byte
+	for _, k := range keys {
+		b = append(b, ssh.Marshal(struct{ Blob []byte }{k.Marshal()})...)
+	}
+	return b
+}
+
+// Decode a sequence of SSH strings.
+//
+func unmarshalStrings(b []byte) ([][]byte, error) {
+	var l [][]byte
+	for len(b) > 0 {
+		var s struct {
+			Value []byte
+			Rest  []byte `ssh:"rest"`
+		}
+		if err := ssh.Unmarshal(b, &s); err != nil {
+			return nil, err
+		}
+		l = append(l, s.Value)
+		b = s.Rest
+	}
+	return l, nil
+}
+
+// The data that a Hub signs to prove possession of a host key.
+//
+func hostKeyProof(session []byte, key ssh.PublicKey) []byte {
+	return ssh.Marshal(struct {
+		Name    string
+		Session []byte
+		Key     []byte
+	}{HostKeysProveRequestName, session, key.Marshal()})
+}
+
+// Advertise the Hub's full set of host keys to the connected agent.
+//
+func (c *connection) advertise(keys []*Key) {
+	l := make([]ssh.PublicKey, 0, len(keys))
+	for _, k := range keys {
+		if k.signer != nil {
+			l = append(l, k.signer.PublicKey())
+		}
+	}
+
+	if _, _, err := c.ssh.SendRequest(HostKeysRequestName, false, marshalKeyBlobs(l)); err != nil {
+		log.Errorf("[hub] unable to advertise host keys to '%s': %s", c.identity, err)
+	}
+}
+
+// Prove, to the connected agent, that the Hub holds the private
+// components of each of the requested host keys, by signing each
+// with our session identifier.
+//
+func (c *connection) prove(keys []*Key, payload []byte) ([]byte, error) {
+	blobs, err := unmarshalStrings(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	for _, blob := range blobs {
+		var signer ssh.Signer
+		for _, k := range keys {
+			if k.signer != nil && string(k.signer.PublicKey().Marshal()) == string(blob) {
+				signer = k.signer
+				break
+			}
+		}
+		if signer == nil {
+			return nil, fmt.Errorf("not one of our host keys")
+		}
+
+		sig, err := signer.Sign(rand.Reader, hostKeyProof(c.ssh.SessionID(), signer.PublicKey()))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ssh.Marshal(struct{ Sig []byte }{ssh.Marshal(sig)})...)
+	}
+	return out, nil
+}
+
+// learnHostKeys handles a hostkeys-00@openssh.com advertisement from
+// an (already authenticated) Hub.  Any advertised keys that are not
+// already in the Agent's KnownHostsFile are checked -- the Hub must
+// prove that it holds their private components -- and then recorded,
+// so that a subsequent rotation of the Hub's host key goes smoothly.
+//
+// Keys are recorded under the Hub's address (i.e. hub.example.com:443
+// for wss://hub.example.com/sfab), which is what the handshake checks.
+//
+func (a *Agent) learnHostKeys(conn ssh.Conn, host string, remote net.Addr, payload []byte) {
+	if a.KnownHostsFile == "" {
+		return
+	}
+	addr := hubAddress(host)
+
+	blobs, err := unmarshalStrings(payload)
+	if err != nil {
+		log.Errorf("[agent %s] malformed host key advertisement from %s: %s", a.Identity, host, err)
+		return
+	}
+
+	var unknown []ssh.PublicKey
+	for _, blob := range blobs {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			log.Debugf("[agent %s] ignoring unparseable host key advertised by %s: %s", a.Identity, host, err)
+			continue
+		}
+		knownHostsLock.Lock()
+		known := knownHostsHas(a.KnownHostsFile, addr, remote, key)
+		knownHostsLock.Unlock()
+		if known {
+			continue
+		}
+		unknown = append(unknown, key)
+	}
+	if len(unknown) == 0 {
+		return
+	}
+
+	ok, reply, err := conn.SendRequest(HostKeysProveRequestName, true, marshalKeyBlobs(unknown))
+	if err != nil || !ok {
+		log.Errorf("[agent %s] hub %s refused to prove possession of its advertised host keys", a.Identity, host)
+		return
+	}
+
+	sigs, err := unmarshalStrings(reply)
+	if err != nil || len(sigs) != len(unknown) {
+		log.Errorf("[agent %s] malformed host key proof from %s", a.Identity, host)
+		return
+	}
+
+	session := conn.SessionID()
+	for i, key := range unknown {
+		sig := &ssh.Signature{}
+		if err := ssh.Unmarshal(sigs[i], sig); err != nil {
+			log.Errorf("[agent %s] malformed host key proof from %s: %s", a.Identity, host, err)
+			return
+		}
+		if err := key.Verify(hostKeyProof(session, key), sig); err != nil {
+			log.Errorf("[agent %s] hub %s failed to prove possession of host key [%s]: %s", a.Identity, host, ssh.FingerprintSHA256(key), err)
+			return
+		}
+	}
+
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+	for _, key := range unknown {
+		log.Infof("[agent %s] learned new host key [%s] for %s; recording it in %s", a.Identity, ssh.FingerprintSHA256(key), host, a.KnownHostsFile)
+		if err := record(a.KnownHostsFile, addr, key); err != nil {
+			log.Errorf("[agent %s] unable to record host key in %s: %s", a.Identity, a.KnownHostsFile, err)
+			return
+		}
+	}
+}
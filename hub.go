@@ -1,8 +1,11 @@
 package sfab
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,8 +15,29 @@ import (
 
 const DefaultKeepAlive time.Duration = 60 * time.Second
 
+// How often the Hub checks for connected agents whose
+// authorizations have lapsed (or are about to).
+//
+const expiryInterval time.Duration = 1 * time.Second
+
 type AgentCallback func(string, Key)
 
+// How long an agent's old key remains valid, after it has
+// rotated to a new key, if the Hub does not set RotationOverlap.
+//
+const DefaultRotationOverlap time.Duration = 24 * time.Hour
+
+// A RotationCallback is called with the name of an agent, its
+// current key, and the new key it wishes to rotate to.  It returns
+// true to approve the rotation, or false to refuse it.
+//
+type RotationCallback func(string, Key, Key) bool
+
+// An ExpiryCallback is called with the name and key of an agent,
+// and the point in time at which its authorization will lapse.
+//
+type ExpiryCallback func(string, Key, time.Time)
+
 // A Hub represents a server from whence jobs to execute are
 // dispatched.  sFAB Agents connect _to_ a Hub, and await
 // instructions.
@@ -31,15 +55,38 @@ type Hub struct {
 	//
 	AllowUnauthorizedAgents bool
 
-	// Which IP protocol (tcp4 or tcp6) to use for binding
-	// the server component of this sFAB Hub.
+	// Which IP protocol (tcp4, tcp6, or tcp for both) to use for
+	// binding the server component of this sFAB Hub.
 	//
 	IPProto string
 
+	// Additional addresses to bind and listen on, alongside Bind
+	// (if set), all of them feeding the same set of agents.  Each
+	// is either a host:port (bound per IPProto), a host:port
+	// prefixed with the protocol to bind it with (i.e.
+	// tcp6:[::]:4771), or a Unix domain socket (unix:/run/sfab.sock,
+	// or just the absolute path to the socket).  Bind accepts all
+	// of these forms, too.
+	//
+	Binds []string
+
 	// Private Key to use for the server component of this Hub.
 	//
 	HostKey *Key
 
+	// Additional Private Keys to use for the server component of
+	// this Hub, either of different algorithms (i.e. Ed25519 in
+	// addition to RSA), or the next key of the same algorithm,
+	// during a host key rotation.
+	//
+	// During the SSH handshake, the Hub presents the first key
+	// (starting with HostKey) of each algorithm.  All host keys
+	// are advertised to connected agents, via the OpenSSH
+	// hostkeys-00@openssh.com extension, so that they can learn
+	// about a new key before the old one is removed.
+	//
+	HostKeys []*Key
+
 	// How frequently to send KeepAlive messages to connected
 	// agents, to keep their TCP transport channels open.
 	//
@@ -58,15 +105,121 @@ type Hub struct {
 	//
 	OnDisconnect AgentCallback
 
+	// How far ahead of a connected agent's authorization expiry
+	// to call the OnExpiring callback.
+	//
+	// By default, no warnings are issued.
+	//
+	ExpiryWarning time.Duration
+
+	// An optional function to be called when a connected agent's
+	// time-bounded authorization is about to lapse (according to
+	// the ExpiryWarning lead time).  It is called at most once
+	// for each distinct expiry.
+	//
+	OnExpiring ExpiryCallback
+
+	// An optional function to be called when a connected agent's
+	// time-bounded authorization lapses, just before the Hub
+	// disconnects it.
+	//
+	OnExpired AgentCallback
+
+	// How long an agent's old key remains valid (alongside the
+	// new one) after an in-band key rotation, before it is
+	// retired.  Agents still connected with the old key at that
+	// point will be disconnected.
+	//
+	// Defaults to DefaultRotationOverlap.
+	//
+	RotationOverlap time.Duration
+
+	// An optional function to be called to approve (or refuse)
+	// an in-band key rotation requested by a connected agent.
+	// If not set, all properly signed rotations are approved.
+	//
+	// This function may block while an operator decides; the
+	// requesting agent will wait for the outcome.
+	//
+	ApproveRotation RotationCallback
+
+	// The Codec to use for encoding the arguments (and decoding
+	// the results) of RPC calls made via Call() and CallStream().
+	//
+	// Defaults to JSONCodec.
+	//
+	RPCCodec Codec
+
+	// An optional function to be called as file transfers (via
+	// PushFile() and PullFile()) make progress.
+	//
+	OnProgress ProgressCallback
+
+	// Which agents are allowed to send messages to which other
+	// agents, via the Hub, using SendTo().  See RelayRules() for
+	// a simple, pattern-based policy.
+	//
+	// By default, no relaying is allowed.
+	//
+	RelayPolicy RelayPolicy
+
+	// A Registry shared by all of the Hubs in a cluster, for
+	// finding out which peer Hub an agent is connected to.  Messages
+	// for agents that aren't connected to this Hub are forwarded
+	// to that peer, over an authenticated hub-to-hub SSH link
+	// (see AuthorizePeer()).
+	//
+	// By default, Hubs are not clustered.
+	//
+	Cluster Registry
+
+	// The address (host:port) that peer Hubs in the cluster should
+	// use to reach this Hub, as recorded in the Cluster registry.
+	//
+	// Defaults to Bind, if that names a host that peers can dial;
+	// Hubs that bind to a wildcard address (i.e. 0.0.0.0:4771) or a
+	// Unix domain socket must set this if they are clustered.
+	//
+	PeerAddress string
+
+	// The load balancers (IP addresses or CIDR ranges) that sit in
+	// front of this Hub, and relay agent connections to it with a
+	// PROXY protocol (v1 or v2) header, so that the Hub can see the
+	// agents' real addresses.  Connections from these addresses
+	// _must_ start with such a header; connections from anywhere
+	// else are never expected to.
+	//
+	// WebSocket connections (see WebSocketHandler()) from these
+	// addresses are taken to be from whatever address they put in
+	// the X-Forwarded-For header, instead.
+	//
+	TrustedProxies []string
+
+	// The addresses (IP addresses or CIDR ranges) that agents are
+	// allowed to connect from, with the real addresses of agents
+	// behind TrustedProxies taken into account.  If empty, agents
+	// can connect from anywhere.
+	//
+	AllowFrom []string
+
 	// Concurrency guard, for access to the agents map
 	// from multiple (handler) goroutines.
 	//
 	lk sync.Mutex
 
-	// The network listener that we await new inbound SSH
+	// The network listeners that we await new inbound SSH
 	// connections on.
 	//
-	listener net.Listener
+	listeners []net.Listener
+
+	// Makes sure that we only start expiring agent keys once,
+	// no matter how many times the Hub is prepared.
+	//
+	expiring sync.Once
+
+	// Closed (by Close()) to stop expiring agent keys.
+	//
+	stop chan struct{}
 
 	// The x/crypto/ssh configuration for setting up the
 	// server <-> client communication channel(s).
@@ -79,59 +232,127 @@ type Hub struct {
 	// A directory of awaited agents.
 	awaits map[string]chan int
 
+	// Subscribers to agent-published events.
+	//
+	subscriptions []*Subscription
+
 	// A KeyMaster, for tracking authorized Agent keys.
 	//
 	keys *KeyMaster
+
+	// Host keys of the peer Hubs that this Hub trusts, and
+	// the live SSH links to those peers, by address.
+	//
+	peerKeys []*Key
+	peers    map[string]ssh.Conn
 }
 
-// Listen binds a network socket for the Hub.
+// Listen binds the network sockets for the Hub: one for Bind, and one
+// for each of the Binds.  If any of them cannot be bound, none
+// of them are.
 //
 func (h *Hub) Listen() error {
+	if err := h.prepare(); err != nil {
+		return err
+	}
+
+	binds := h.Binds
+	if h.Bind != "" || len(binds) == 0 {
+		binds = append([]string{h.Bind}, binds...)
+	}
+
+	listeners := make([]net.Listener, 0, len(binds))
+	for _, bind := range binds {
+		network, address := h.bindAddress(bind)
+		l, err := net.Listen(network, address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		log.Debugf("[hub] bound %s %s", network, address)
+		listeners = append(listeners, l)
+	}
+
+	h.listeners = listeners
+	return nil
+}
+
+// bindAddress splits an entry from Bind (or Binds) into the network
+// and the address to bind on it.
+//
+func (h *Hub) bindAddress(bind string) (string, string) {
+	if strings.HasPrefix(bind, "/") {
+		return "unix", bind
+	}
+	for _, network := range []string{"unix", "tcp", "tcp4", "tcp6"} {
+		if strings.HasPrefix(bind, network+":") {
+			return network, strings.TrimPrefix(bind, network+":")
+		}
+	}
+	return h.IPProto, bind
+}
+
+// prepare validates the Hub's configuration, and sets up everything
+// it needs to accept agent connections, whether inbound (via Listen()
+// and Serve()) or outbound (via DialAgent()).
+//
+func (h *Hub) prepare() error {
 	h.lock()
-	h.agents = make(map[string]*connection)
-	h.awaits = make(map[string]chan int)
+	if h.agents == nil {
+		h.agents = make(map[string]*connection)
+	}
+	if h.awaits == nil {
+		h.awaits = make(map[string]chan int)
+	}
 	h.unlock()
 
 	if h.IPProto == "" {
 		h.IPProto = "tcp4"
 	}
 
-	if h.HostKey == nil {
+	if h.HostKey == nil && len(h.HostKeys) == 0 {
 		return fmt.Errorf("missing HostKey in Hub object.")
 	}
-
-	h.init()
-	ck := &ssh.CertChecker{
-		UserKeyFallback: h.keys.userKeyCallback(),
-		IsUserAuthority: func(key ssh.PublicKey) bool {
-			return false
-		},
-	}
-
-	h.config = &ssh.ServerConfig{
-		PublicKeyCallback: ck.Authenticate,
+	for _, key := range h.hostKeys() {
+		if !key.IsPrivateKey() {
+			return fmt.Errorf("host key [%s] is not a private key", key.Fingerprint())
+		}
 	}
-	h.config.AddHostKey(h.HostKey.signer)
 
-	var err error
-	h.listener, err = net.Listen(h.IPProto, h.Bind)
-	if err != nil {
+	if err := h.checkPeerAddress(); err != nil {
 		return err
 	}
 
+	h.init()
+	h.lock()
+	h.configure()
+	h.unlock()
+
+	/* however agents end up connected (listeners, reverse dials or
+	   WebSockets), their authorizations lapse all the same */
+	h.expiring.Do(func() {
+		stop := make(chan struct{})
+		h.lock()
+		h.stop = stop
+		h.unlock()
+		go h.expire(expiryInterval, stop)
+	})
 	return nil
 }
 
-// Serve handls inbound cnnections on the listening socket, and
+// Serve handls inbound cnnections on the listening sockets, and
 // services those agents, distributing messages via a session
 // channel and an exec request, each.
 //
 // It is the caller's responsibility to call Listen() before
 // invoking this method, or to dispense with both and just use
-// ListenAndServe().
+// ListenAndServe().  This method blocks until one of the listeners
+// fails, at which point it closes the rest, and returns the error.
 //
 func (h *Hub) Serve() error {
-	if h.listener == nil {
+	if len(h.listeners) == 0 {
 		return fmt.Errorf("this hub has no listener (did you forget to call Listen() first?)")
 	}
 
@@ -139,35 +360,140 @@ func (h *Hub) Serve() error {
 		h.KeepAlive = DefaultKeepAlive
 	}
 
+	errs := make(chan error, len(h.listeners))
+	for _, l := range h.listeners {
+		go func(l net.Listener) {
+			errs <- h.serve(l)
+		}(l)
+	}
+	err := <-errs
+
+	/* don't leave the other listeners running, unattended */
+	for _, l := range h.listeners {
+		l.Close()
+	}
+	for range h.listeners[1:] {
+		<-errs
+	}
+	return err
+}
+
+// ServeListener handles inbound connections on a listener of the
+// caller's choosing, be it a Unix domain socket, a socket inherited
+// from systemd, or an in-memory listener, exactly as Serve() does for
+// the listeners bound by Listen().  There's no need to call Listen()
+// first, and ServeListener() can be called for several listeners at
+// once (each in its own goroutine), all feeding the same set of agents.
+//
+// This method blocks until the listener fails (i.e. is closed),
+// returning its error.
+//
+func (h *Hub) ServeListener(l net.Listener) error {
+	if err := h.ready(); err != nil {
+		return err
+	}
+	return h.serve(l)
+}
+
+// serve accepts inbound connections on a single listener, until it
+// fails for good.
+//
+func (h *Hub) serve(l net.Listener) error {
 	for {
-		log.Debugf("[hub] awaiting inbound connections...")
+		log.Debugf("[hub] awaiting inbound connections on %s...", l.Addr())
 
-		socket, err := h.listener.Accept()
+		socket, err := l.Accept()
 		if err != nil {
-			log.Debugf("[hub] failed to accept inbound connection: %s", err)
-			continue
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Debugf("[hub] failed to accept inbound connection: %s", err)
+				continue
+			}
+			log.Errorf("[hub] no longer accepting inbound connections on %s: %s", l.Addr(), err)
+			return err
 		}
 
-		log.Debugf("[hub] inbound connection accepted; starting SSH handshake...")
-		c, chans, reqs, err := ssh.NewServerConn(socket, h.config)
+		socket, err = h.unproxy(socket)
 		if err != nil {
-			log.Debugf("[hub] failed to negotiate SSH transport: %s", err)
+			log.Errorf("[hub] failed to accept inbound connection: %s", err)
 			continue
 		}
 
-		log.Infof("[hub] registering agent '%s' with public key: %s\n", c.User(), c.Permissions.Extensions[PublicKeyExtensionName])
-		connection, err := h.register(c.User(), c)
+		log.Debugf("[hub] inbound connection from %s accepted; starting SSH handshake...", socket.RemoteAddr())
+		c, chans, reqs, err := h.handshake(socket)
 		if err != nil {
-			log.Errorf("[hub] failed to register agent '%s': %s", c.User(), err)
-			c.Conn.Close()
+			log.Debugf("[hub] failed to negotiate SSH transport: %s", err)
 			continue
 		}
-		go connection.Serve(chans, reqs, h.KeepAlive)
-		if h.OnConnect != nil {
-			log.Infof("[hub] calling onconnect handler for '%s'", connection.identity)
-			h.OnConnect(connection.identity, *connection.key)
-		}
+
+		h.admit(c, chans, reqs)
+	}
+}
+
+// ready makes sure that the Hub is prepared to accept agent
+// connections that don't come in through its listener (i.e. via
+// DialAgent() or WebSocketHandler()), even if it isn't listening.
+//
+func (h *Hub) ready() error {
+	h.lock()
+	ready := h.config != nil
+	h.unlock()
+
+	if ready {
+		return nil
+	}
+	return h.prepare()
+}
+
+// handshake negotiates the SSH transport (as the server) with an
+// agent (or a peer Hub), over a freshly connected socket, including
+// authentication.
+//
+func (h *Hub) handshake(socket net.Conn) (*ssh.ServerConn, <-chan ssh.NewChannel, <-chan *ssh.Request, error) {
+	h.lock()
+	config := h.config
+	h.unlock()
+
+	c, chans, reqs, err := ssh.NewServerConn(socket, config)
+	if err != nil {
+		socket.Close()
+	}
+	return c, chans, reqs, err
+}
+
+// admit registers a newly authenticated agent (or peer Hub link), and
+// starts servicing its connection.
+//
+func (h *Hub) admit(c *ssh.ServerConn, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) error {
+	if c.Permissions != nil && c.Permissions.Extensions[PeerExtensionName] != "" {
+		log.Infof("[hub] accepted peer link from hub %s", c.RemoteAddr())
+		go h.servePeer(c, chans, reqs)
+		return nil
 	}
+
+	log.Infof("[hub] registering agent '%s' from %s with public key: %s\n", c.User(), c.RemoteAddr(), c.Permissions.Extensions[PublicKeyExtensionName])
+	connection, err := h.register(c.User(), c)
+	if err != nil {
+		log.Errorf("[hub] failed to register agent '%s': %s", c.User(), err)
+		c.Conn.Close()
+		return err
+	}
+
+	keepalive := h.KeepAlive
+	if keepalive <= 0 {
+		keepalive = DefaultKeepAlive
+	}
+
+	h.enlist(connection.identity)
+	go connection.Serve(chans, reqs, keepalive)
+	h.lock()
+	keys := h.hostKeys()
+	h.unlock()
+	go connection.advertise(keys)
+	if h.OnConnect != nil {
+		log.Infof("[hub] calling onconnect handler for '%s'", connection.identity)
+		h.OnConnect(connection.identity, *connection.key)
+	}
+	return nil
 }
 
 // ListenAndServe combines both the Listen() and Serve()
@@ -186,6 +512,152 @@ func (h *Hub) ListenAndServe() error {
 	return h.Serve()
 }
 
+// Close shuts the Hub down: the listeners bound by Listen() are
+// closed (so that Serve() returns), and agent authorizations are no
+// longer checked for expiry.  Listeners handed to ServeListener()
+// belong to the caller, who is responsible for closing them.
+//
+// A Hub cannot be reused once it has been closed.
+//
+func (h *Hub) Close() error {
+	/* a Hub that was never prepared shouldn't start expiring later */
+	h.expiring.Do(func() {})
+
+	h.lock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+	h.unlock()
+
+	for _, l := range h.listeners {
+		l.Close()
+	}
+	return nil
+}
+
+// hostKeys returns all of the Hub's host keys, starting with
+// HostKey (if set), followed by the HostKeys.
+//
+func (h *Hub) hostKeys() []*Key {
+	l := make([]*Key, 0, len(h.HostKeys)+1)
+	if h.HostKey != nil {
+		l = append(l, h.HostKey)
+	}
+	return append(l, h.HostKeys...)
+}
+
+// configure (re-)builds the x/crypto/ssh server configuration,
+// from the current set of host keys.  The caller must hold the
+// Hub lock.
+//
+func (h *Hub) configure() {
+	ck := &ssh.CertChecker{
+		UserKeyFallback: h.keys.userKeyCallback(),
+		IsUserAuthority: func(key ssh.PublicKey) bool {
+			return false
+		},
+	}
+
+	h.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if meta.User() == PeerUser {
+				return h.authenticatePeer(key)
+			}
+			if !h.allowsAddress(meta.RemoteAddr()) {
+				return nil, fmt.Errorf("agent '%s' not allowed to connect from %s", meta.User(), meta.RemoteAddr())
+			}
+			return ck.Authenticate(meta, key)
+		},
+	}
+
+	/* x/crypto/ssh keeps the _last_ key of each algorithm,
+	   but we want to present the _first_ one we were given. */
+	seen := make(map[string]bool)
+	for _, key := range h.hostKeys() {
+		if key.signer == nil || seen[key.Type()] {
+			continue
+		}
+		seen[key.Type()] = true
+		h.config.AddHostKey(key.signer)
+	}
+}
+
+// AddHostKey adds a new host key to the Hub, and advertises it
+// to all connected agents, so that they can start trusting it
+// before the Hub starts presenting it.
+//
+// This can be called dynamically, long after a call to Listen(),
+// or before.
+//
+func (h *Hub) AddHostKey(key *Key) error {
+	if key == nil || !key.IsPrivateKey() {
+		return fmt.Errorf("host keys must be private keys")
+	}
+
+	h.lock()
+	h.HostKeys = append(h.HostKeys, key)
+	keys := h.hostKeys()
+	conns := h.connections()
+	if h.config != nil {
+		h.configure()
+	}
+	h.unlock()
+
+	log.Infof("[hub] added host key [%s]; advertising it to %d connected agent(s)", key.Fingerprint(), len(conns))
+	for _, c := range conns {
+		go c.advertise(keys)
+	}
+	return nil
+}
+
+// RemoveHostKey stops the Hub from using the given host key
+// (matched by fingerprint), usually at the end of a host key
+// rotation.  The remaining keys are re-advertised to all
+// connected agents.
+//
+// This can be called dynamically, long after a call to Listen(),
+// or before.
+//
+func (h *Hub) RemoveHostKey(key *Key) error {
+	h.lock()
+	var keys []*Key
+	for _, k := range h.hostKeys() {
+		if k.Fingerprint() != key.Fingerprint() {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		h.unlock()
+		return fmt.Errorf("cannot remove the last host key")
+	}
+
+	h.HostKey = nil
+	h.HostKeys = keys
+	conns := h.connections()
+	if h.config != nil {
+		h.configure()
+	}
+	h.unlock()
+
+	log.Infof("[hub] removed host key [%s]", key.Fingerprint())
+	for _, c := range conns {
+		go c.advertise(keys)
+	}
+	return nil
+}
+
+// connections returns all of the currently registered agent
+// connections.  The caller must hold the Hub lock.
+//
+func (h *Hub) connections() []*connection {
+	l := make([]*connection, 0, len(h.agents))
+	for _, c := range h.agents {
+		l = append(l, c)
+	}
+	return l
+}
+
 func (h *Hub) init() {
 	if h.keys == nil {
 		h.keys = &KeyMaster{
@@ -213,6 +685,36 @@ func (h *Hub) AuthorizeKey(agent string, key *Key) {
 	h.authorizeKey(agent, key)
 }
 
+// AuthorizeKeyUntil tells the Hub to trust a given SSH key pair,
+// given the public component, for a named agent, but only until
+// the given expiry.  Agents that are still connected when their
+// authorization lapses will be disconnected.
+//
+// This can be called dynamically, long after a call to Listen(),
+// or before.
+//
+func (h *Hub) AuthorizeKeyUntil(agent string, key *Key, expiry time.Time) {
+	h.AuthorizeKeyBetween(agent, key, time.Time{}, expiry)
+}
+
+// AuthorizeKeyBetween tells the Hub to trust a given SSH key pair,
+// given the public component, for a named agent, but only within
+// the validity window bounded by notBefore and notAfter.  Either
+// can be the zero time.Time, to leave that side of the window
+// open-ended.
+//
+// This can be called dynamically, long after a call to Listen(),
+// or before.
+//
+func (h *Hub) AuthorizeKeyBetween(agent string, key *Key, notBefore, notAfter time.Time) {
+	h.lock()
+	defer h.unlock()
+
+	log.Debugf("authorizing subject '%s' with key [%s] from %s until %s", agent, key.Fingerprint(), notBefore, notAfter)
+	h.init()
+	h.keys.AuthorizeBetween(key, notBefore, notAfter, agent)
+}
+
 func (h *Hub) deauthorizeKey(agent string, key *Key) {
 	h.init()
 	h.keys.Deauthorize(key, agent)
@@ -240,31 +742,128 @@ func (h *Hub) DeauthorizeKey(agent string, key *Key) {
 // ultimate exit code) will be sent via the returned channel.
 //
 func (h *Hub) Send(agent string, message []byte, timeout time.Duration) (chan *Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	responses, err := h.send(ctx, agent, Message{payload: message})
+	if err == context.DeadlineExceeded {
+		return nil, fmt.Errorf("agent did not respond within %ds", int(timeout.Seconds()))
+	}
+	return responses, err
+}
+
+// SendRaw sends a message to an agent (by name), just like Send(),
+// except that output is relayed verbatim, as chunks of bytes (see
+// the Bytes() and Offset() methods of Response), instead of being
+// split up into lines.  This is the way to go for binary output, or
+// output with very long lines.
+//
+func (h *Hub) SendRaw(agent string, message []byte, timeout time.Duration) (chan *Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	responses, err := h.send(ctx, agent, Message{payload: message, raw: true})
+	if err == context.DeadlineExceeded {
+		return nil, fmt.Errorf("agent did not respond within %ds", int(timeout.Seconds()))
+	}
+	return responses, err
+}
+
+// SendStream sends a message to an agent (by name), along with an input
+// stream, which the agent's Handler can read as its standard input.  The
+// input is copied to the agent until it is exhausted (or the execution
+// finishes, whichever comes first).  Output is split up into lines, just
+// like with Send().
+//
+// The context governs both how long to wait for the agent to pick up
+// the message, and the execution itself: if it is cancelled before the
+// Handler finishes, the session is closed (which cancels the context
+// passed to the Handler), and an error Response is sent.
+//
+func (h *Hub) SendStream(ctx context.Context, agent string, message []byte, stdin io.Reader) (chan *Response, error) {
+	return h.send(ctx, agent, Message{
+		payload: message,
+		stdin:   stdin,
+		ctx:     ctx,
+	})
+}
+
+// send a message to an agent (by name), waiting until the given
+// context is done for the agent to pick it up.
+//
+func (h *Hub) send(ctx context.Context, agent string, msg Message) (chan *Response, error) {
 	h.lock()
 	c, ok := h.agents[agent]
 	h.unlock()
 
 	if ok {
 		if h.keys.Authorized(agent, c.key) {
-			msg := Message{
-				responses: make(chan *Response),
-				payload:   message,
-			}
+			msg.responses = make(chan *Response)
 			select {
 			case c.messages <- msg:
 				return msg.responses, nil
 
-			case <-time.After(timeout):
-				return nil, fmt.Errorf("agent did not respond within %ds", int(timeout.Seconds()))
+			case <-ctx.Done():
+				return nil, ctx.Err()
 			}
 		} else {
 			return nil, fmt.Errorf("agent found but not authorized: %s", agent)
 		}
+	} else if relay, name, found := h.namespaced(agent); found {
+		return h.descend(ctx, relay, name, msg)
+	} else if peer, found := h.locate(agent); found && !msg.local {
+		return h.forward(ctx, peer, agent, msg)
 	} else {
 		return nil, fmt.Errorf("agent not found: %s", agent)
 	}
 }
 
+// connected looks up a connected (and authorized) agent, by name.
+//
+func (h *Hub) connected(agent string) (*connection, error) {
+	h.lock()
+	c, ok := h.agents[agent]
+	h.unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("agent not found: %s", agent)
+	}
+	if !h.keys.Authorized(agent, c.key) {
+		return nil, fmt.Errorf("agent found but not authorized: %s", agent)
+	}
+	return c, nil
+}
+
+// Commands asks an agent (by name) for the list of commands that
+// it knows how to handle.  This only works for agents whose Handler
+// is (or includes) a Mux.
+//
+func (h *Hub) Commands(agent string, timeout time.Duration) ([]string, error) {
+	res, err := h.Send(agent, []byte(ListCommandsPayload), timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		l      []string
+		failed error
+	)
+	for r := range res {
+		switch {
+		case r.IsStdout():
+			l = append(l, r.Text())
+		case r.IsError():
+			failed = r.Error()
+		case r.IsExit() && r.ExitCode() != 0:
+			failed = fmt.Errorf("agent '%s' does not support command discovery (exited %d)", agent, r.ExitCode())
+		}
+	}
+	if failed != nil {
+		return nil, failed
+	}
+	return l, nil
+}
+
 // IgnoreReplies takes a response channel from a
 // call to Send() and discards all of the responses
 // that are sent across.
@@ -293,6 +892,51 @@ func (h *Hub) Agents() []string {
 	return agents
 }
 
+// AgentInfo describes an agent that is connected to a Hub.
+//
+type AgentInfo struct {
+	// The agent's identity, i.e. agent@host.
+	//
+	Identity string
+
+	// The address the agent connected from; for agents behind a
+	// load balancer (see TrustedProxies), this is the agent's real
+	// address, not the load balancer's.
+	//
+	Address net.Addr
+
+	// The fingerprint of the key the agent authenticated with.
+	//
+	KeyFingerprint string
+
+	// When the agent connected.
+	//
+	Connected time.Time
+}
+
+// AgentInfo returns what the Hub knows about a connected agent, or
+// AgentNotFoundError if there is no such agent.
+//
+func (h *Hub) AgentInfo(agent string) (AgentInfo, error) {
+	h.lock()
+	defer h.unlock()
+
+	c, ok := h.agents[agent]
+	if !ok {
+		return AgentInfo{}, AgentNotFoundError
+	}
+
+	info := AgentInfo{
+		Identity:  c.identity,
+		Address:   c.ssh.RemoteAddr(),
+		Connected: c.since,
+	}
+	if c.key != nil {
+		info.KeyFingerprint = c.key.Fingerprint()
+	}
+	return info, nil
+}
+
 // KnowsAgent checks the Hub's agent directory to see if
 // a named agent has registered with this Hub.
 //
@@ -310,6 +954,9 @@ func (h *Hub) Await(agent string) chan int {
 	if ch, ok := h.awaits[agent]; ok {
 		return ch
 	} else {
+		if h.awaits == nil {
+			h.awaits = make(map[string]chan int)
+		}
 		ch := make(chan int)
 		h.awaits[agent] = ch
 		return ch
@@ -333,12 +980,19 @@ func (h *Hub) register(name string, conn *ssh.ServerConn) (*connection, error) {
 
 	h.agents[name] = &connection{
 		ssh:      conn,
+		hub:      h,
 		messages: make(chan Message),
 		hangup:   make(chan int, 1),
 		identity: conn.User(),
 		key:      h.keys.publicKeyUsed(conn),
+		since:    time.Now(),
+
+		/* so that we notice if this lapses before the next tick */
+		expiry: h.keys.expiry(conn.User(), h.keys.publicKeyUsed(conn)),
 
 		done: func() {
+			h.delist(name)
+
 			h.lock()
 			defer h.unlock()
 			log.Infof("[hub] deregistering agent '%v'...", conn.User())
@@ -359,6 +1013,140 @@ func (h *Hub) register(name string, conn *ssh.ServerConn) (*connection, error) {
 	return h.agents[name], nil
 }
 
+// rotate handles an in-band key rotation request from a connected
+// agent.  The rotation must be for the agent's own identity, and must
+// be signed by the key that the agent authenticated with (which must
+// still be authorized).  Once approved, the new key is authorized for
+// the identity, and the old key is retired after the RotationOverlap.
+//
+func (h *Hub) rotate(c *connection, payload []byte) error {
+	r, err := UnmarshalRotation(payload)
+	if err != nil {
+		return fmt.Errorf("malformed key rotation request: %s", err)
+	}
+	if r.Identity != c.identity {
+		return fmt.Errorf("agent '%s' cannot rotate keys for '%s'", c.identity, r.Identity)
+	}
+	if c.key == nil {
+		return fmt.Errorf("agent '%s' has no known key", c.identity)
+	}
+	if err := r.Verify(c.key); err != nil {
+		return fmt.Errorf("key rotation signature verification failed: %s", err)
+	}
+
+	h.lock()
+	authorized := h.keys.Authorized(c.identity, c.key)
+	h.unlock()
+	if !authorized {
+		return fmt.Errorf("agent '%s' is not authorized", c.identity)
+	}
+
+	if h.ApproveRotation != nil && !h.ApproveRotation(c.identity, *c.key, *r.NewKey) {
+		return fmt.Errorf("key rotation refused")
+	}
+
+	overlap := h.RotationOverlap
+	if overlap <= 0 {
+		overlap = DefaultRotationOverlap
+	}
+	retire := time.Now().Add(overlap)
+
+	h.lock()
+	expiry := h.keys.expiry(c.identity, c.key)
+	h.keys.AuthorizeUntil(r.NewKey, expiry, c.identity)
+	if expiry.IsZero() || retire.Before(expiry) {
+		h.keys.AuthorizeUntil(c.key, retire, c.identity)
+	}
+	h.unlock()
+
+	log.Infof("[hub] agent '%s' rotated from key [%s] to key [%s]; old key will be retired at %s",
+		c.identity, c.key.Fingerprint(), r.NewKey.Fingerprint(), retire)
+
+	old := c.key
+	time.AfterFunc(overlap, func() {
+		h.retireKey(c.identity, old)
+	})
+	return nil
+}
+
+// retireKey deauthorizes a key for the named agent, and disconnects
+// the agent, if it is still connected with that key.
+//
+func (h *Hub) retireKey(agent string, key *Key) {
+	h.lock()
+	h.keys.Deauthorize(key, agent)
+	c, ok := h.agents[agent]
+	h.unlock()
+
+	log.Infof("[hub] retired key [%s] for agent '%s'", key.Fingerprint(), agent)
+	if ok && c.key != nil && c.key.Fingerprint() == key.Fingerprint() {
+		log.Infof("[hub] agent '%s' is still connected with retired key [%s]; disconnecting...", agent, key.Fingerprint())
+		c.Hangup()
+	}
+}
+
+// expire (which ought to be run in a goroutine) periodically
+// checks all registered agents for time-bounded authorizations
+// that are about to lapse (firing the OnExpiring callback), or
+// that have lapsed (firing the OnExpired callback, and then
+// disconnecting the agent), until the stop channel is closed.
+//
+func (h *Hub) expire(t time.Duration, stop chan struct{}) {
+	tick := time.NewTicker(t)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick.C:
+		}
+
+		var warn, lapsed []*connection
+
+		h.lock()
+		now := time.Now()
+		for _, c := range h.agents {
+			if c.key == nil {
+				continue
+			}
+
+			expiry := h.keys.expiry(c.identity, c.key)
+			if expiry.IsZero() {
+				if !c.expiry.IsZero() && !now.Before(c.expiry) {
+					lapsed = append(lapsed, c)
+				}
+				c.expiry = time.Time{}
+				continue
+			}
+
+			if !expiry.Equal(c.expiry) {
+				c.expiry = expiry
+				c.warned = false
+			}
+			if !c.warned && h.ExpiryWarning > 0 && expiry.Sub(now) <= h.ExpiryWarning {
+				c.warned = true
+				warn = append(warn, c)
+			}
+		}
+		h.unlock()
+
+		for _, c := range warn {
+			log.Infof("[hub] authorization for agent '%s' expires at %s", c.identity, c.expiry)
+			if h.OnExpiring != nil {
+				h.OnExpiring(c.identity, *c.key, c.expiry)
+			}
+		}
+		for _, c := range lapsed {
+			log.Infof("[hub] authorization for agent '%s' has expired; disconnecting...", c.identity)
+			if h.OnExpired != nil {
+				h.OnExpired(c.identity, *c.key)
+			}
+			c.Hangup()
+		}
+	}
+}
+
 func (h *Hub) Authorizations() []Authorization {
 	h.lock()
 	defer h.unlock()
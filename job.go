@@ -0,0 +1,129 @@
+package sfab
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+)
+
+// A Job is a single message, sent to a single agent, via Submit().
+// Its output can either be streamed, via Responses(), or collected
+// up all at once, via Result().
+//
+type Job struct {
+	// The name of the agent that the Job was sent to.
+	//
+	Agent string
+
+	// The message payload that was sent.
+	//
+	Payload []byte
+
+	// When the Job was submitted to the Hub, and when the agent
+	// picked it up for execution.
+	//
+	Submitted time.Time
+	Started   time.Time
+
+	responses chan *Response
+}
+
+// A Result is the final outcome of a Job, with all of its output.
+//
+type Result struct {
+	// The complete standard output and standard error of the
+	// Job, verbatim.
+	//
+	Stdout []byte
+	Stderr []byte
+
+	// The exit code of the Job, if it exited normally, or the
+	// error it failed with, if it didn't.
+	//
+	ExitCode int
+	Error    error
+
+	// When the Job was submitted to the Hub, when the agent
+	// picked it up for execution, and when it finished.
+	//
+	Submitted time.Time
+	Started   time.Time
+	Finished  time.Time
+
+	// How long the Job waited for the agent to pick it up, and
+	// how long it then took to run.
+	//
+	QueueTime time.Duration
+	RunTime   time.Duration
+}
+
+// Submit sends a message to an agent (by name), in raw mode (see
+// SendRaw()), and returns the Job that tracks it.  Returns an error
+// if the named agent is not currently registered with this Hub, or
+// if it does not pick up the Job within the given timeout.
+//
+func (h *Hub) Submit(agent string, message []byte, timeout time.Duration) (*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	job := &Job{
+		Agent:     agent,
+		Payload:   message,
+		Submitted: time.Now(),
+	}
+
+	responses, err := h.send(ctx, agent, Message{payload: message, raw: true})
+	if err == context.DeadlineExceeded {
+		return nil, fmt.Errorf("agent did not respond within %ds", int(timeout.Seconds()))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	job.Started = time.Now()
+	job.responses = responses
+	return job, nil
+}
+
+// Responses returns the channel of raw-mode Responses for the Job,
+// for callers that want to stream its output.  Callers that use
+// this should not also call Result().
+//
+func (j *Job) Responses() chan *Response {
+	return j.responses
+}
+
+// Result waits for the Job to finish, and returns its Result.
+//
+func (j *Job) Result() *Result {
+	var stdout, stderr bytes.Buffer
+	r := &Result{
+		Submitted: j.Submitted,
+		Started:   j.Started,
+	}
+
+	for resp := range j.responses {
+		switch {
+		case resp.IsStdout():
+			stdout.Write(resp.Bytes())
+		case resp.IsStderr():
+			stderr.Write(resp.Bytes())
+		case resp.IsExit():
+			r.ExitCode = resp.ExitCode()
+			r.Finished = resp.Time()
+		case resp.IsError():
+			r.Error = resp.Error()
+			r.Finished = resp.Time()
+		}
+	}
+
+	if r.Finished.IsZero() {
+		r.Finished = time.Now()
+	}
+	r.Stdout = stdout.Bytes()
+	r.Stderr = stderr.Bytes()
+	r.QueueTime = r.Started.Sub(r.Submitted)
+	r.RunTime = r.Finished.Sub(r.Started)
+	return r
+}
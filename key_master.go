@@ -2,7 +2,7 @@ package sfab
 
 import (
 	"fmt"
-	"net"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -22,6 +22,27 @@ const (
 type authorization struct {
 	disposition disposition
 	publicKey   *Key
+
+	// The validity window of an authorization.  Outside of
+	// this window, an Authorized disposition is treated as if
+	// it were unknown.  A zero time leaves that side of the
+	// window open-ended.
+	//
+	notBefore time.Time
+	notAfter  time.Time
+}
+
+// Whether or not an authorization is within its validity window,
+// as of the given point in time.
+//
+func (a *authorization) valid(now time.Time) bool {
+	if !a.notBefore.IsZero() && now.Before(a.notBefore) {
+		return false
+	}
+	if !a.notAfter.IsZero() && !now.Before(a.notAfter) {
+		return false
+	}
+	return true
 }
 
 // A KeyMaster handles the specifics of tracking which SSH key pairs
@@ -46,14 +67,44 @@ type KeyMaster struct {
 // Authorize a key pair for one or more subjects (either hostnames,
 // IP addresses, or agent names).
 //
+// Subjects can also be patterns: shell-style globs like `*@postgres.ql`,
+// `web-??.prod` or `db-[0-9]*`, or CIDR network ranges like `10.0.0.0/8`
+// (for matching IP addresses).  An exact subject always takes precedence
+// over a pattern, and an explicit deauthorization always takes precedence
+// over an authorization of the same specificity.
+//
 func (m *KeyMaster) Authorize(key *Key, subjects ...string) {
-	if key != nil {
-		m.track(key, Authorized, subjects...)
+	m.AuthorizeBetween(key, time.Time{}, time.Time{}, subjects...)
+}
+
+// AuthorizeUntil authorizes a key pair for one or more subjects, but
+// only until the given expiry.  After that point in time, the key is
+// treated as if it had never been authorized.
+//
+func (m *KeyMaster) AuthorizeUntil(key *Key, expiry time.Time, subjects ...string) {
+	m.AuthorizeBetween(key, time.Time{}, expiry, subjects...)
+}
+
+// AuthorizeBetween authorizes a key pair for one or more subjects,
+// for the validity window bounded by notBefore and notAfter.  Either
+// bound can be the zero time.Time, to leave that side of the window
+// open-ended.
+//
+func (m *KeyMaster) AuthorizeBetween(key *Key, notBefore, notAfter time.Time, subjects ...string) {
+	if key == nil {
+		return
+	}
+
+	k := m.track(key, Authorized, subjects...)
+	for _, s := range subjects {
+		m.keys[k][s].notBefore = notBefore
+		m.keys[k][s].notAfter = notAfter
 	}
 }
 
 // Deauthorize a key pair for one or more subjects (either hostnames,
-// IP addresses, or agent names).
+// IP addresses, or agent names).  Like Authorize(), subjects can be
+// glob or CIDR patterns.
 //
 func (m *KeyMaster) Deauthorize(key *Key, subjects ...string) {
 	if key != nil {
@@ -97,20 +148,114 @@ func (m *KeyMaster) Authorized(subject string, key *Key) bool {
 }
 
 func (m *KeyMaster) authorized(subject string, key ssh.PublicKey) bool {
-	k := fmt.Sprintf("%s", ssh.FingerprintSHA256(key))
+	disp, _ := m.decide(time.Now(), key, subject)
+	return disp == Authorized
+}
 
+// Determine when the authorization of a public key for the given
+// subject lapses.  If the key is not currently authorized, or if its
+// authorization never expires, the zero time.Time is returned.
+//
+func (m *KeyMaster) expiry(subject string, key *Key) time.Time {
+	if key == nil {
+		return time.Time{}
+	}
+	disp, expiry := m.decide(time.Now(), key.sshpub, subject)
+	if disp != Authorized {
+		return time.Time{}
+	}
+	return expiry
+}
+
+// Determine the disposition of a public key for one or more
+// subjects (i.e. a hostname and its IP address), taking into account
+// both exact subject matches and patterns (globs and CIDR ranges),
+// as of a given point in time.
+//
+// Precedence is deterministic: an exact match always beats a
+// pattern match, and amongst all of the matching entries (at the
+// same level of specificity), an explicit deauthorization always
+// beats an authorization.  Authorizations outside of their validity
+// window are ignored entirely.
+//
+// Along with the disposition, decide() returns the point in time at
+// which an Authorized disposition will lapse, or the zero time.Time
+// if it never will.
+//
+func (m *KeyMaster) decide(now time.Time, key ssh.PublicKey, subjects ...string) (disposition, time.Time) {
 	if m.keys == nil {
-		return false
+		return UnknownDisposition, time.Time{}
 	}
 
-	if _, ok := m.keys[k]; !ok {
-		return false
+	k := fmt.Sprintf("%s", ssh.FingerprintSHA256(key))
+	authz, ok := m.keys[k]
+	if !ok {
+		return UnknownDisposition, time.Time{}
 	}
-	v, ok := m.keys[k][subject]
-	if !ok || v.disposition == UnknownDisposition  {
-		v, ok = m.keys[k][Wildcard]
+
+	exact := verdict{}
+	for _, s := range subjects {
+		if v, ok := authz[s]; ok {
+			exact.consider(now, v)
+		}
 	}
-	return ok && v.disposition == Authorized
+	if exact.disposition != UnknownDisposition {
+		return exact.disposition, exact.expiry
+	}
+
+	pattern := verdict{}
+	for p, v := range authz {
+		if !isPattern(p) {
+			continue
+		}
+		for _, s := range subjects {
+			if matchSubject(p, s) {
+				pattern.consider(now, v)
+			}
+		}
+	}
+	return pattern.disposition, pattern.expiry
+}
+
+// A verdict accumulates the dispositions of all the authorizations
+// that apply to a subject (at a single level of specificity), along
+// with the latest expiry of those that authorize it.
+//
+type verdict struct {
+	disposition disposition
+	expiry      time.Time
+	forever     bool
+}
+
+func (v *verdict) consider(now time.Time, a *authorization) {
+	disp := a.disposition
+	if disp == Authorized && !a.valid(now) {
+		disp = UnknownDisposition
+	}
+	v.disposition = strongest(v.disposition, disp)
+
+	if disp == Authorized && !v.forever {
+		if a.notAfter.IsZero() {
+			v.forever = true
+			v.expiry = time.Time{}
+		} else if a.notAfter.After(v.expiry) {
+			v.expiry = a.notAfter
+		}
+	}
+}
+
+// Combine two dispositions, giving explicit deauthorization
+// precedence over authorization, and both precedence over the
+// unknown disposition.
+//
+func strongest(a, b disposition) disposition {
+	if a == NotAuthorized || b == NotAuthorized {
+		return NotAuthorized
+	}
+	if a == Authorized || b == Authorized {
+		return Authorized
+	}
+	return UnknownDisposition
 }
 
 // Provide a callback function that can be used by SSH servers
@@ -133,24 +278,6 @@ func (m *KeyMaster) userKeyCallback() func(ssh.ConnMetadata, ssh.PublicKey) (*ss
 	}
 }
 
-// Provide a callback function that can be used by SSH clients
-// to whitelist authorized host keys during SSH connection negotiation.
-//
-func (m *KeyMaster) hostKeyCallback() ssh.HostKeyCallback {
-	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		if m.authorized(hostname, key) {
-			return nil
-		}
-		if m.authorized(remote.String(), key) {
-			return nil
-		}
-		if m.authorized(Wildcard, key) {
-			return nil
-		}
-		return fmt.Errorf("unrecognized host key")
-	}
-}
-
 func (m *KeyMaster) publicKeyUsed(conn *ssh.ServerConn) *Key {
 	k := conn.Permissions.Extensions[PublicKeyExtensionName]
 	if _, exists := m.keys[k]; !exists {
@@ -168,14 +295,18 @@ type Authorization struct {
 	KeyFingerprint string
 	Authorized     bool
 	Known          bool
+	NotBefore      time.Time
+	NotAfter       time.Time
 }
 
 func (m KeyMaster) Authorizations() []Authorization {
 	var l []Authorization
 
+	now := time.Now()
 	for k := range m.keys {
 		for s, authz := range m.keys[k] {
-			if s == Wildcard {
+			/* patterns (including the Wildcard) aren't identities */
+			if isPattern(s) {
 				continue
 			}
 
@@ -183,8 +314,10 @@ func (m KeyMaster) Authorizations() []Authorization {
 				PublicKey:      authz.publicKey,
 				Identity:       s,
 				KeyFingerprint: k,
-				Authorized:     authz.disposition == Authorized,
+				Authorized:     authz.disposition == Authorized && authz.valid(now),
 				Known:          authz.disposition != UnknownDisposition,
+				NotBefore:      authz.notBefore,
+				NotAfter:       authz.notAfter,
 			})
 		}
 	}
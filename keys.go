@@ -1,6 +1,8 @@
 package sfab
 
 import (
+	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -12,10 +14,10 @@ import (
 )
 
 type Key struct {
-	private *rsa.PrivateKey
+	private crypto.Signer
 	signer  ssh.Signer
 
-	public *rsa.PublicKey
+	public crypto.PublicKey
 	sshpub ssh.PublicKey
 }
 
@@ -37,7 +39,20 @@ func (k Key) Public() *Key {
 	}
 }
 
-func wrap(private *rsa.PrivateKey, public *rsa.PublicKey) (*Key, error) {
+// Type returns the SSH key algorithm name of this key,
+// i.e. "ssh-rsa" or "ssh-ed25519".
+//
+func (k Key) Type() string {
+	if k.sshpub != nil {
+		return k.sshpub.Type()
+	}
+	if k.signer != nil {
+		return k.signer.PublicKey().Type()
+	}
+	return ""
+}
+
+func wrap(private crypto.Signer, public crypto.PublicKey) (*Key, error) {
 	k := &Key{}
 
 	if private != nil {
@@ -50,7 +65,7 @@ func wrap(private *rsa.PrivateKey, public *rsa.PublicKey) (*Key, error) {
 		k.signer = signer
 
 		if public == nil {
-			public = private.Public().(*rsa.PublicKey)
+			public = private.Public()
 		}
 	}
 
@@ -80,6 +95,30 @@ func GenerateKey(bits int) (*Key, error) {
 	return wrap(key, nil)
 }
 
+// GenerateEd25519Key generates a new Ed25519 key pair, which can
+// be used alongside (or instead of) RSA keys, i.e. as an additional
+// Hub host key.
+//
+func GenerateEd25519Key() (*Key, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrap(key, nil)
+}
+
+// wrapPublic wraps an SSH public key (i.e. one parsed from the
+// wire) as a public-only Key.
+//
+func wrapPublic(pub ssh.PublicKey) (*Key, error) {
+	crypto, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key type '%s'", pub.Type())
+	}
+	return wrap(nil, crypto.CryptoPublicKey())
+}
+
 func ParseKey(b []byte) (*Key, error) {
 	block, _ := pem.Decode(b)
 	if block == nil {
@@ -101,6 +140,24 @@ func ParseKey(b []byte) (*Key, error) {
 		}
 		return wrap(nil, key)
 
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return wrap(signer, nil)
+
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return wrap(nil, key)
+
 	default:
 		return nil, fmt.Errorf("unrecognized key type '%s'", block.Type)
 	}
@@ -126,18 +183,44 @@ func (k Key) IsPublicKey() bool {
 	return k.public != nil
 }
 
+// Encode the key as a PEM block.  RSA keys are encoded as PKCS#1
+// "RSA PRIVATE KEY" / "RSA PUBLIC KEY" blocks; all others as PKCS#8
+// "PRIVATE KEY" or PKIX "PUBLIC KEY" blocks.
+//
 func (k Key) Encode() []byte {
 	if k.private != nil {
+		if rsakey, ok := k.private.(*rsa.PrivateKey); ok {
+			return pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PRIVATE KEY",
+				Bytes: x509.MarshalPKCS1PrivateKey(rsakey),
+			})
+		}
+
+		b, err := x509.MarshalPKCS8PrivateKey(k.private)
+		if err != nil {
+			return nil
+		}
 		return pem.EncodeToMemory(&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: x509.MarshalPKCS1PrivateKey(k.private),
+			Type:  "PRIVATE KEY",
+			Bytes: b,
 		})
 	}
 
 	if k.public != nil {
+		if rsakey, ok := k.public.(*rsa.PublicKey); ok {
+			return pem.EncodeToMemory(&pem.Block{
+				Type:  "RSA PUBLIC KEY",
+				Bytes: x509.MarshalPKCS1PublicKey(rsakey),
+			})
+		}
+
+		b, err := x509.MarshalPKIXPublicKey(k.public)
+		if err != nil {
+			return nil
+		}
 		return pem.EncodeToMemory(&pem.Block{
-			Type:  "RSA PUBLIC KEY",
-			Bytes: x509.MarshalPKCS1PublicKey(k.public),
+			Type:  "PUBLIC KEY",
+			Bytes: b,
 		})
 	}
 
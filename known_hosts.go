@@ -0,0 +1,232 @@
+package sfab
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Serializes updates to known_hosts files, across all Agents in this
+// process, so that concurrent trust-on-first-use recordings don't
+// clobber one another.
+//
+var knownHostsLock sync.Mutex
+
+// A hostKeyChecker validates the host keys presented by Hubs, first
+// against explicitly authorized keys (via Agent.AuthorizeKey), and
+// then against an OpenSSH known_hosts-style file.  It remembers the
+// reason for the last rejection, since x/crypto/ssh flattens host key
+// callback errors into a generic handshake failure.
+//
+type hostKeyChecker struct {
+	keys  *KeyMaster
+	file  string
+	tofu  bool
+	agent string
+
+	err error
+}
+
+func (c *hostKeyChecker) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	c.err = c.verify(hostname, remote, key)
+	return c.err
+}
+
+func (c *hostKeyChecker) verify(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if c.keys != nil {
+		disp, _ := c.keys.decide(time.Now(), key, hostSubjects(hostname, remote)...)
+		if disp == Authorized {
+			return nil
+		}
+		if disp == NotAuthorized || c.file == "" {
+			return UnrecognizedHostKeyError
+		}
+	}
+
+	if c.file == "" {
+		return nil
+	}
+
+	/* hubs that dial in (to a listening agent) are known by
+	   their IP address alone; knownhosts insists on a port */
+	if _, _, err := net.SplitHostPort(hostname); err != nil {
+		hostname = net.JoinHostPort(hostname, "22")
+	}
+
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+
+	if c.tofu {
+		if err := touch(c.file); err != nil {
+			return err
+		}
+	}
+
+	check, err := knownhosts.New(c.file)
+	if os.IsNotExist(err) {
+		return UnrecognizedHostKeyError
+	}
+	if err != nil {
+		return err
+	}
+
+	err = check(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	if ke, ok := err.(*knownhosts.KeyError); ok {
+		/* knownhosts only considers the first key of each type
+		   listed for a host, but we may have learned a second one
+		   (i.e. during a host key rotation), so check them all. */
+		if len(ke.Want) > 0 && knownHostsHas(c.file, hostname, remote, key) {
+			return nil
+		}
+
+		if len(ke.Want) > 0 {
+			log.Errorf("[agent %s] host key for %s has CHANGED!  got [%s], but %s:%d expected [%s]",
+				c.agent, hostname, ssh.FingerprintSHA256(key), ke.Want[0].Filename, ke.Want[0].Line, ssh.FingerprintSHA256(ke.Want[0].Key))
+			return HostKeyChangedError
+		}
+
+		if c.tofu {
+			log.Infof("[agent %s] trusting host key [%s] for %s on first use; recording it in %s",
+				c.agent, ssh.FingerprintSHA256(key), hostname, c.file)
+			return record(c.file, hostname, key)
+		}
+		return UnrecognizedHostKeyError
+	}
+
+	if _, ok := err.(*knownhosts.RevokedError); ok {
+		log.Errorf("[agent %s] host key [%s] for %s has been revoked", c.agent, ssh.FingerprintSHA256(key), hostname)
+		return UnrecognizedHostKeyError
+	}
+	return err
+}
+
+// touch creates an empty file (and its parent directories), unless
+// it already exists.
+//
+func touch(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// record appends a host key to a known_hosts file.
+//
+func record(path, hostname string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s\n", knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
+
+// knownHostsHas checks if a known_hosts file lists the given key for
+// the given host (by name or remote address), considering every line
+// that matches the host, not just the first one of each key type.
+//
+func knownHostsHas(path, hostname string, remote net.Addr, key ssh.PublicKey) bool {
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	candidates := []string{knownhosts.Normalize(hostname)}
+	if remote != nil {
+		candidates = append(candidates, knownhosts.Normalize(remote.String()))
+	}
+
+	for len(in) > 0 {
+		marker, hosts, pub, _, rest, err := ssh.ParseKnownHosts(in)
+		if err != nil {
+			return false
+		}
+		in = rest
+
+		if marker != "" || !bytes.Equal(pub.Marshal(), key.Marshal()) {
+			continue
+		}
+		for _, candidate := range candidates {
+			if knownHostMatch(hosts, candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// knownHostMatch checks a (normalized) host address against the host
+// patterns from a single known_hosts line, which may be hashed, may
+// contain wildcards, and may be negated.
+//
+func knownHostMatch(patterns []string, address string) bool {
+	host, port := splitKnownHost(address)
+
+	matched := false
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		ok := false
+		if strings.HasPrefix(p, "|1|") {
+			parts := strings.Split(p, "|")
+			if len(parts) != 4 {
+				continue
+			}
+			salt, err1 := base64.StdEncoding.DecodeString(parts[2])
+			hash, err2 := base64.StdEncoding.DecodeString(parts[3])
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			mac := hmac.New(sha1.New, salt)
+			mac.Write([]byte(address))
+			ok = hmac.Equal(mac.Sum(nil), hash)
+
+		} else {
+			h, p := splitKnownHost(p)
+			ok = glob(h, host) && p == port
+		}
+
+		if ok && negate {
+			return false
+		}
+		matched = matched || ok
+	}
+	return matched
+}
+
+// splitKnownHost splits a known_hosts host entry (either `host`,
+// or `[host]:port`) into its host and port components.
+//
+func splitKnownHost(s string) (string, string) {
+	if strings.HasPrefix(s, "[") {
+		if i := strings.LastIndex(s, "]:"); i > 0 {
+			return s[1:i], s[i+2:]
+		}
+		return strings.Trim(s, "[]"), "22"
+	}
+	return s, "22"
+}
@@ -1,5 +1,11 @@
 package sfab
 
+import (
+	"context"
+	"io"
+	"time"
+)
+
 type from int
 
 const (
@@ -11,10 +17,13 @@ const (
 )
 
 type Response struct {
-	from from
-	text string
-	err  error
-	rc   int
+	from   from
+	text   string
+	data   []byte
+	offset int64
+	at     time.Time
+	err    error
+	rc     int
 }
 
 func (r Response) IsStdout() bool {
@@ -33,10 +42,44 @@ func (r Response) IsError() bool {
 	return r.from == fromError
 }
 
+// Text returns the output carried by this Response, as a string.
+// In line mode (i.e. via Send()), this is a single line of output,
+// without its trailing newline.  In raw mode (i.e. via SendRaw()),
+// it is a chunk of output, verbatim.
+//
 func (r Response) Text() string {
+	if r.data != nil {
+		return string(r.data)
+	}
 	return r.text
 }
 
+// Bytes returns the output carried by this Response.  In raw mode
+// (i.e. via SendRaw()), this is a chunk of output, verbatim, which
+// may contain binary data, and need not end on a line boundary.
+//
+func (r Response) Bytes() []byte {
+	if r.data != nil {
+		return r.data
+	}
+	return []byte(r.text)
+}
+
+// Offset returns the position (in bytes) of the start of the output
+// carried by this Response, within its output stream (standard output
+// or standard error).  This is only tracked in raw mode.
+//
+func (r Response) Offset() int64 {
+	return r.offset
+}
+
+// Time returns the point in time at which this Response was received
+// by the Hub.
+//
+func (r Response) Time() time.Time {
+	return r.at
+}
+
 func (r Response) ExitCode() int {
 	return r.rc
 }
@@ -48,4 +91,24 @@ func (r Response) Error() error {
 type Message struct {
 	responses chan *Response
 	payload   []byte
+
+	// Whether or not to relay output as raw chunks of bytes,
+	// instead of splitting it up into lines.
+	//
+	raw bool
+
+	// An optional input stream, to copy to the agent as the
+	// standard input of its Handler.
+	//
+	stdin io.Reader
+
+	// An optional context that, when done, aborts the execution.
+	//
+	ctx context.Context
+
+	// Whether or not the message must be delivered to an agent
+	// connected to this Hub, rather than forwarded to a peer Hub
+	// (i.e. because a peer already forwarded it here).
+	//
+	local bool
 }
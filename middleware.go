@@ -0,0 +1,364 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A Middleware wraps a StreamHandler in another StreamHandler, to take
+// care of cross-cutting concerns (logging, panic recovery, timeouts,
+// etc.) without cluttering up the Handler itself.
+//
+type Middleware func(StreamHandler) StreamHandler
+
+// Chain composes several Middleware into one.  The first Middleware
+// given is the outermost; it sees the payload first, and the result
+// last.  So, in:
+//
+//     h = sfab.Chain(sfab.Recover(), sfab.Timeout(time.Minute))(h)
+//
+// a panic in the timeout machinery (or in h) is recovered.
+//
+func Chain(middleware ...Middleware) Middleware {
+	return func(h StreamHandler) StreamHandler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			h = middleware[i](h)
+		}
+		return h
+	}
+}
+
+// An ExitSignal is an error that a Handler can return to signal
+// that it terminated abnormally, much like a Unix process that was
+// killed by a signal.  Instead of an exit code, the Hub is sent an
+// "exit-signal" (per section 6.10 of RFC-4254), which surfaces as
+// an error Response.
+//
+// Unlike any other error returned by a Handler, an ExitSignal does
+// not terminate the Agent.
+//
+type ExitSignal struct {
+	// The name of the signal, without the "SIG" prefix (i.e. "ABRT"
+	// or "ALRM").
+	//
+	Signal string
+
+	// A human-readable explanation of what went wrong.
+	//
+	Message string
+}
+
+func (e *ExitSignal) Error() string {
+	return fmt.Sprintf("%s (SIG%s)", e.Message, e.Signal)
+}
+
+func (e *ExitSignal) marshal() []byte {
+	return ssh.Marshal(struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}{e.Signal, false, e.Message, ""})
+}
+
+// Recover returns a Middleware that recovers from any panic in the
+// Handler it wraps, turning it into an ABRT ExitSignal that carries
+// the panic message.  The stack trace is written to standard error.
+//
+func Recover() Middleware {
+	return func(next StreamHandler) StreamHandler {
+		return func(ctx context.Context, payload []byte, stdin io.Reader, stdout, stderr io.Writer) (rc int, err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					rc, err = 0, aborted(r, stderr)
+				}
+			}()
+			return next(ctx, payload, stdin, stdout, stderr)
+		}
+	}
+}
+
+// aborted turns a recovered panic into an ABRT ExitSignal, writing
+// the stack trace to standard error.
+//
+func aborted(r interface{}, stderr io.Writer) *ExitSignal {
+	fmt.Fprintf(stderr, "panic: %v\n%s", r, debug.Stack())
+	return &ExitSignal{
+		Signal:  "ABRT",
+		Message: fmt.Sprintf("panic: %v", r),
+	}
+}
+
+// Timeout returns a Middleware that limits how long the Handler it
+// wraps can run for.  If the Handler is still running when the time
+// is up, an ALRM ExitSignal is returned in its place.
+//
+// The Handler's context is cancelled when the time is up, but it is
+// up to the Handler to notice that and stop.  Either way, it is
+// abandoned, and any further output it produces is discarded.
+//
+// Since the Handler runs in a goroutine of its own, out of reach of
+// any Recover() further up the Chain, a panic in the Handler is
+// recovered here, and returned as an ABRT ExitSignal.
+//
+func Timeout(d time.Duration) Middleware {
+	return func(next StreamHandler) StreamHandler {
+		return func(ctx context.Context, payload []byte, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+			ctx, cancel := context.WithTimeout(ctx, d)
+			defer cancel()
+
+			out := &gatedWriter{w: stdout}
+			errs := &gatedWriter{w: stderr}
+
+			done := make(chan status, 1)
+			go func() {
+				defer func() {
+					if r := recover(); r != nil {
+						done <- status{err: aborted(r, errs)}
+					}
+				}()
+				rc, err := next(ctx, payload, stdin, out, errs)
+				done <- status{code: rc, err: err}
+			}()
+
+			select {
+			case st := <-done:
+				return st.code, st.err
+
+			case <-ctx.Done():
+				out.close()
+				errs.close()
+				return 0, &ExitSignal{
+					Signal:  "ALRM",
+					Message: fmt.Sprintf("timed out after %s", d),
+				}
+			}
+		}
+	}
+}
+
+// An Execution records the particulars of a single run of a
+// Handler, for access logging and metrics.
+//
+type Execution struct {
+	Payload  []byte
+	Start    time.Time
+	Duration time.Duration
+
+	// The exit code returned by the Handler, or, if it terminated
+	// abnormally, the name of the signal (from its ExitSignal).
+	//
+	ExitCode int
+	Signal   string
+
+	// Any error returned by the Handler (including ExitSignals).
+	//
+	Error error
+
+	// How many bytes of output were written to standard output
+	// and standard error.
+	//
+	Stdout int64
+	Stderr int64
+}
+
+// Measure returns a Middleware that times each run of the Handler
+// it wraps, and passes the details to the given function.  This is
+// the building block for both AccessLog() and Metrics.
+//
+func Measure(fn func(Execution)) Middleware {
+	return func(next StreamHandler) StreamHandler {
+		return func(ctx context.Context, payload []byte, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+			out := &countingWriter{w: stdout}
+			errs := &countingWriter{w: stderr}
+
+			x := Execution{
+				Payload: payload,
+				Start:   time.Now(),
+			}
+			rc, err := next(ctx, payload, stdin, out, errs)
+
+			x.Duration = time.Since(x.Start)
+			x.ExitCode = rc
+			x.Error = err
+			if sig, ok := err.(*ExitSignal); ok {
+				x.Signal = sig.Signal
+			}
+			x.Stdout = out.count()
+			x.Stderr = errs.count()
+			fn(x)
+
+			return rc, err
+		}
+	}
+}
+
+// AccessLog returns a Middleware that writes a single line to w for
+// each run of the Handler it wraps, in logfmt (key=value) format, i.e.:
+//
+//     time=2020-05-20T12:34:56Z payload="reconcile web" duration=1.5s rc=0 stdout=120 stderr=0
+//
+func AccessLog(w io.Writer) Middleware {
+	var lk sync.Mutex
+	return Measure(func(x Execution) {
+		line := fmt.Sprintf("time=%s payload=%q duration=%s rc=%d stdout=%d stderr=%d",
+			x.Start.UTC().Format(time.RFC3339), string(x.Payload), x.Duration, x.ExitCode, x.Stdout, x.Stderr)
+		if x.Signal != "" {
+			line += fmt.Sprintf(" signal=%s", x.Signal)
+		}
+		if x.Error != nil {
+			line += fmt.Sprintf(" error=%q", x.Error.Error())
+		}
+
+		lk.Lock()
+		defer lk.Unlock()
+		fmt.Fprintln(w, line)
+	})
+}
+
+// Metrics aggregates duration and exit code statistics across all
+// runs of the Handlers that its Middleware() wraps.  The zero value
+// is ready to use, and it is safe for concurrent use.
+//
+type Metrics struct {
+	lk       sync.Mutex
+	runs     int
+	total    time.Duration
+	longest  time.Duration
+	codes    map[int]int
+	signals  map[string]int
+	failures int
+}
+
+// Middleware returns a Middleware that records each run of the
+// Handler it wraps into these Metrics.
+//
+func (m *Metrics) Middleware() Middleware {
+	return Measure(m.observe)
+}
+
+func (m *Metrics) observe(x Execution) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.codes == nil {
+		m.codes = make(map[int]int)
+		m.signals = make(map[string]int)
+	}
+
+	m.runs++
+	m.total += x.Duration
+	if x.Duration > m.longest {
+		m.longest = x.Duration
+	}
+	if x.Signal != "" {
+		m.signals[x.Signal]++
+	} else {
+		m.codes[x.ExitCode]++
+	}
+	if x.Error != nil || x.ExitCode != 0 {
+		m.failures++
+	}
+}
+
+// Runs returns how many times the Handler(s) have been run, and how
+// many of those runs failed (either exiting non-zero, or returning
+// an error).
+//
+func (m *Metrics) Runs() (int, int) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.runs, m.failures
+}
+
+// Durations returns the total and the longest run time of the
+// Handler(s).
+//
+func (m *Metrics) Durations() (time.Duration, time.Duration) {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+	return m.total, m.longest
+}
+
+// ExitCodes returns how many runs finished with each exit code.
+//
+func (m *Metrics) ExitCodes() map[int]int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	codes := make(map[int]int, len(m.codes))
+	for k, v := range m.codes {
+		codes[k] = v
+	}
+	return codes
+}
+
+// Signals returns how many runs terminated with each ExitSignal.
+//
+func (m *Metrics) Signals() map[string]int {
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	signals := make(map[string]int, len(m.signals))
+	for k, v := range m.signals {
+		signals[k] = v
+	}
+	return signals
+}
+
+// A countingWriter counts the bytes written through it.
+//
+type countingWriter struct {
+	lk sync.Mutex
+	w  io.Writer
+	n  int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.lk.Lock()
+	c.n += int64(n)
+	c.lk.Unlock()
+	return n, err
+}
+
+func (c *countingWriter) count() int64 {
+	c.lk.Lock()
+	defer c.lk.Unlock()
+	return c.n
+}
+
+// A gatedWriter passes writes through until it is closed, after
+// which it (silently) discards them.  Closing never waits on a
+// write that is already under way (which may be stuck behind a
+// stalled channel); that write is left to finish, or fail, on its
+// own.
+//
+type gatedWriter struct {
+	lk     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+func (g *gatedWriter) Write(b []byte) (int, error) {
+	g.lk.Lock()
+	closed := g.closed
+	g.lk.Unlock()
+
+	if closed {
+		return len(b), nil
+	}
+	return g.w.Write(b)
+}
+
+func (g *gatedWriter) close() {
+	g.lk.Lock()
+	g.closed = true
+	g.lk.Unlock()
+}
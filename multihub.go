@@ -0,0 +1,182 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultReconnectInterval will be used as a fallback, should an Agent
+// not set its ReconnectInterval attribute, for ConnectAll().
+//
+const DefaultReconnectInterval time.Duration = 5 * time.Second
+
+// A hubConn is a live SSH connection from an Agent to a Hub.
+//
+type hubConn struct {
+	host string
+	conn ssh.Conn
+}
+
+// A HubState describes the state of an Agent's connection to a Hub.
+//
+type HubState struct {
+	// The address of the Hub (i.e. hub.example.com:4771).
+	//
+	Hub string
+
+	// Whether or not the Agent is currently connected to the
+	// Hub, and since when.
+	//
+	Connected bool
+	Since     time.Time
+
+	// How many times in a row the Agent has tried (and failed)
+	// to connect to the Hub, and why the last attempt (or the
+	// last connection) failed, if it did.
+	//
+	Attempts  int
+	LastError error
+}
+
+type hubContextKey struct{}
+
+// HubFromContext returns the address of the Hub that sent the message
+// that a Handler is working on, given the Handler's context.  This is
+// most useful for Agents that are connected to several Hubs at once.
+//
+func HubFromContext(ctx context.Context) (string, bool) {
+	hub, ok := ctx.Value(hubContextKey{}).(string)
+	return hub, ok
+}
+
+// ConnectAll connects to each of the given Hubs (by address, over TCP),
+// and responds to execution requests from all of them with the passed
+// Handler.  Each connection is maintained independently; if one goes
+// away (or cannot be made), the Agent waits for ReconnectInterval and
+// tries again, without disturbing the others.
+//
+// Messages from different Hubs are handled concurrently, so the Handler
+// must be safe to call from multiple goroutines.  Use HubFromContext()
+// to find out which Hub sent a given message, and Hubs() to keep track
+// of the state of each connection.
+//
+// This method blocks until the context is done (returning its error),
+// or until the Handler asks for the Agent to terminate (returning nil),
+// at which point all connections are closed.
+//
+func (a *Agent) ConnectAll(ctx context.Context, hubs []string, handler StreamHandler) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	if len(hubs) == 0 {
+		return fmt.Errorf("no hubs to connect to")
+	}
+
+	interval := a.ReconnectInterval
+	if interval == 0 {
+		interval = DefaultReconnectInterval
+	}
+
+	handler = a.rpc(handler)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		halted = make(chan struct{})
+		once   sync.Once
+	)
+	for _, hub := range hubs {
+		a.hubState(hub, func(*HubState) {})
+
+		wg.Add(1)
+		go func(hub string) {
+			defer wg.Done()
+			for {
+				halt, err := a.connect(ctx, "tcp", hub, handler)
+				if halt {
+					once.Do(func() { close(halted) })
+					cancel()
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					log.Errorf("[agent %s] unable to connect to hub %s: %s", a.Identity, hub, err)
+				} else {
+					log.Infof("[agent %s] lost connection to hub %s", a.Identity, hub)
+				}
+
+				log.Debugf("[agent %s] reconnecting to hub %s in %s...", a.Identity, hub, interval)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+			}
+		}(hub)
+	}
+	wg.Wait()
+
+	select {
+	case <-halted:
+		return nil
+	default:
+		return ctx.Err()
+	}
+}
+
+// Hubs returns the state of each of the Hubs that this Agent has tried
+// to connect to, via Connect() or ConnectAll().
+//
+func (a *Agent) Hubs() []HubState {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	l := make([]HubState, len(a.hubs))
+	for i, st := range a.hubs {
+		l[i] = *st
+	}
+	return l
+}
+
+// hubState updates the state of a single Hub, by address, under the
+// Agent's concurrency guard.
+//
+func (a *Agent) hubState(hub string, fn func(*HubState)) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	for _, st := range a.hubs {
+		if st.Hub == hub {
+			fn(st)
+			return
+		}
+	}
+
+	st := &HubState{Hub: hub}
+	a.hubs = append(a.hubs, st)
+	fn(st)
+}
+
+// forgetHub drops the state of a Hub, by address, once the Agent no
+// longer expects to hear from it again (i.e. for Hubs that dialed in
+// to ListenAndServe(), from an ephemeral port).
+//
+func (a *Agent) forgetHub(hub string) {
+	a.lk.Lock()
+	defer a.lk.Unlock()
+
+	for i, st := range a.hubs {
+		if st.Hub == hub {
+			a.hubs = append(a.hubs[:i], a.hubs[i+1:]...)
+			return
+		}
+	}
+}
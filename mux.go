@@ -0,0 +1,208 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	// The exit code that a Mux returns when it is asked to run a
+	// command that it has no Handler for.  This mirrors what most
+	// Unix shells do for "command not found".
+	//
+	UnknownCommandExitCode = 127
+
+	// The payload that asks a Mux to list (on standard output, one
+	// per line) the commands that it has Handlers for.  This is used
+	// by the Hub's Commands() method, for discovery.
+	//
+	ListCommandsPayload = "sfab-commands"
+)
+
+// A Mux is a command multiplexer for Agents.  It routes each payload
+// it receives to one of a set of registered Handlers, based on the
+// first word of the payload (the verb), much like net/http's ServeMux
+// routes requests based on their URL path.
+//
+// Patterns are either verbs (like `reconcile`), which must match the
+// first word of the payload exactly, or paths ending in a slash (like
+// `/files/`), which match any first word that starts with them.  When
+// several paths match, the longest one wins; verbs always beat paths.
+//
+// The payload passed on to the routed Handler is whatever follows the
+// matched pattern, minus any leading whitespace.  The Args() helper
+// can be used to split that into individual arguments.
+//
+// A Mux routes to StreamHandlers (plain Handlers can be registered via
+// their Stream() method), and its Dispatch method is itself a
+// StreamHandler, which can be passed directly to an Agent's
+// ConnectStream() method:
+//
+//     mux := &sfab.Mux{}
+//     mux.Handle("reconcile", reconcile)
+//     mux.Handle("/files/", files)
+//     agent.ConnectStream("tcp4", "hub:4771", mux.Dispatch)
+//
+type Mux struct {
+	// An optional Handler to run for payloads that do not match
+	// any of the registered patterns.  It is passed the entire
+	// payload.  If not set, the Mux prints an error to standard
+	// error and exits UnknownCommandExitCode.
+	//
+	NotFound StreamHandler
+
+	lk       sync.RWMutex
+	handlers map[string]StreamHandler
+}
+
+// Handle registers a Handler for the given pattern (either a verb,
+// or a path prefix ending in a slash).  Registering a Handler for a
+// pattern that already has one replaces it.
+//
+func (m *Mux) Handle(pattern string, handler StreamHandler) {
+	if pattern == "" || strings.IndexFunc(pattern, unicode.IsSpace) >= 0 {
+		panic(fmt.Sprintf("sfab: invalid mux pattern '%s'", pattern))
+	}
+	if handler == nil {
+		panic(fmt.Sprintf("sfab: nil handler for mux pattern '%s'", pattern))
+	}
+
+	m.lk.Lock()
+	defer m.lk.Unlock()
+
+	if m.handlers == nil {
+		m.handlers = make(map[string]StreamHandler)
+	}
+	m.handlers[pattern] = handler
+}
+
+// Commands returns the (sorted) list of patterns that this Mux has
+// registered Handlers for.
+//
+func (m *Mux) Commands() []string {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	l := make([]string, 0, len(m.handlers))
+	for pattern := range m.handlers {
+		l = append(l, pattern)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Dispatch routes a payload to the appropriate Handler, and returns
+// whatever that Handler returns.  Its signature makes it a
+// StreamHandler.
+//
+func (m *Mux) Dispatch(ctx context.Context, payload []byte, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	cmd := string(payload)
+	verb := cmd
+	if i := strings.IndexFunc(cmd, unicode.IsSpace); i >= 0 {
+		verb = cmd[:i]
+	}
+
+	if verb == ListCommandsPayload {
+		for _, pattern := range m.Commands() {
+			fmt.Fprintf(stdout, "%s\n", pattern)
+		}
+		return 0, nil
+	}
+
+	if pattern, handler := m.match(verb); handler != nil {
+		rest := strings.TrimLeftFunc(cmd[len(pattern):], unicode.IsSpace)
+		return handler(ctx, []byte(rest), stdin, stdout, stderr)
+	}
+
+	if m.NotFound != nil {
+		return m.NotFound(ctx, payload, stdin, stdout, stderr)
+	}
+	fmt.Fprintf(stderr, "unknown command '%s'\n", verb)
+	return UnknownCommandExitCode, nil
+}
+
+// Find the pattern (and Handler) that best matches the given verb.
+//
+func (m *Mux) match(verb string) (string, StreamHandler) {
+	m.lk.RLock()
+	defer m.lk.RUnlock()
+
+	if h, ok := m.handlers[verb]; ok {
+		return verb, h
+	}
+
+	best := ""
+	for pattern := range m.handlers {
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(verb, pattern) && len(pattern) > len(best) {
+			best = pattern
+		}
+	}
+	if best == "" {
+		return "", nil
+	}
+	return best, m.handlers[best]
+}
+
+// Args splits a payload into individual arguments, much like a Unix
+// shell would: on whitespace, honoring single quotes, double quotes
+// and backslash escapes.
+//
+func Args(payload []byte) ([]string, error) {
+	var (
+		args  []string
+		arg   strings.Builder
+		quote rune
+		in    bool
+		esc   bool
+	)
+
+	for _, c := range string(payload) {
+		switch {
+		case esc:
+			arg.WriteRune(c)
+			esc = false
+
+		case c == '\\' && quote != '\'':
+			esc = true
+			in = true
+
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+
+		case c == '\'' || c == '"':
+			quote = c
+			in = true
+
+		case unicode.IsSpace(c):
+			if in {
+				args = append(args, arg.String())
+				arg.Reset()
+				in = false
+			}
+
+		default:
+			arg.WriteRune(c)
+			in = true
+		}
+	}
+
+	if esc {
+		return nil, fmt.Errorf("trailing backslash in arguments")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c-quoted argument", quote)
+	}
+	if in {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
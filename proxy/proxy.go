@@ -0,0 +1,166 @@
+// Package proxy provides an http.Handler that proxies HTTP requests
+// through an sFAB Hub, to HTTP servers listening on the loopback
+// interface of its connected agents (metrics endpoints, admin pages,
+// and the like).
+//
+// Requests are routed by path:
+//
+//     /agents/{identity}/proxy/{port}/...
+//
+// is proxied to http://127.0.0.1:{port}/... on the named agent, which
+// must list that port in its ExposePorts.  Each request is carried
+// over a forwarded TCP connection, tunnelled through the agent's SSH
+// connection to the Hub (see sfab.Hub.Dial).
+//
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/jhunt/go-log"
+
+	"github.com/jhunt/go-sfab"
+)
+
+// DefaultPrefix is the path prefix that a Handler serves under, if
+// it does not set its own Prefix.
+//
+const DefaultPrefix = "/agents/"
+
+// Upstream connections are made to fake hostnames that encode the
+// agent identity, so that pooled (keep-alive) connections to one
+// agent never get re-used for requests to another.
+//
+const upstreamSuffix = ".agent.sfab"
+
+// A Handler proxies HTTP requests to agent-local HTTP servers.
+//
+type Handler struct {
+	// The Hub to tunnel requests through.
+	//
+	Hub *sfab.Hub
+
+	// The path prefix that this handler is mounted at, i.e.
+	// "/agents/" (the default).  It must begin and end with
+	// a forward slash.
+	//
+	Prefix string
+
+	once  sync.Once
+	proxy *httputil.ReverseProxy
+}
+
+// New creates a Handler that tunnels requests through the given Hub.
+//
+func New(hub *sfab.Hub) *Handler {
+	return &Handler{Hub: hub}
+}
+
+// target identifies an agent-local HTTP server, as parsed from
+// an incoming request path.
+//
+type target struct {
+	prefix string
+	agent  string
+	port   int
+	path   string
+}
+
+// parse picks apart a request path of the form:
+//
+//     {prefix}{identity}/proxy/{port}/...
+//
+func (h *Handler) parse(path string) (target, bool) {
+	prefix := h.Prefix
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return target{}, false
+	}
+
+	l := strings.SplitN(strings.TrimPrefix(path, prefix), "/", 4)
+	if len(l) < 3 || l[0] == "" || l[1] != "proxy" {
+		return target{}, false
+	}
+	port, err := strconv.Atoi(l[2])
+	if err != nil || port <= 0 || port > 65535 {
+		return target{}, false
+	}
+
+	t := target{
+		prefix: prefix + l[0] + "/proxy/" + l[2],
+		agent:  l[0],
+		port:   port,
+		path:   "/",
+	}
+	if len(l) == 4 {
+		t.path += l[3]
+	}
+	return t, true
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t, ok := h.parse(r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.Hub.KnowsAgent(t.agent) {
+		http.Error(w, fmt.Sprintf("agent '%s' not found", t.agent), http.StatusNotFound)
+		return
+	}
+
+	h.once.Do(func() {
+		h.proxy = h.reverseProxy()
+	})
+
+	log.Debugf("[proxy] proxying %s %s to port %d on agent '%s'", r.Method, t.path, t.port, t.agent)
+	r2 := r.Clone(r.Context())
+	r2.URL.Scheme = "http"
+	r2.URL.Host = hex.EncodeToString([]byte(t.agent)) + upstreamSuffix + ":" + strconv.Itoa(t.port)
+	r2.URL.Path = t.path
+	r2.URL.RawPath = ""
+	r2.Host = "localhost:" + strconv.Itoa(t.port)
+	r2.Header.Set("X-Forwarded-Prefix", t.prefix)
+	h.proxy.ServeHTTP(w, r2)
+}
+
+// reverseProxy builds the underlying reverse proxy, with a transport
+// that dials through the Hub.
+//
+func (h *Handler) reverseProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {},
+		Transport: &http.Transport{
+			DialContext: h.dial,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Errorf("[proxy] unable to proxy %s %s: %s", r.Method, r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+}
+
+// dial opens a connection to an agent-local port, given an upstream
+// address made up by ServeHTTP().
+//
+func (h *Handler) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	agent, err := hex.DecodeString(strings.TrimSuffix(host, upstreamSuffix))
+	if err != nil || !strings.HasSuffix(host, upstreamSuffix) {
+		return nil, fmt.Errorf("invalid upstream address '%s'", addr)
+	}
+	return h.Hub.Dial(ctx, string(agent), "tcp", net.JoinHostPort("127.0.0.1", port))
+}
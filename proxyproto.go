@@ -0,0 +1,197 @@
+package sfab
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-log"
+)
+
+// How long a trusted load balancer gets to send us its PROXY
+// protocol header, before we give up on the connection.
+//
+const proxyHeaderTimeout = 10 * time.Second
+
+// The twelve bytes that every PROXY protocol v2 header starts with.
+//
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// unproxy reads the PROXY protocol header off of a freshly accepted
+// connection, if it comes from one of the Hub's TrustedProxies, and
+// returns a connection whose RemoteAddr() is that of the agent on the
+// far side of the load balancer.  Connections from anywhere else are
+// returned untouched.
+//
+func (h *Hub) unproxy(socket net.Conn) (net.Conn, error) {
+	if !h.trustsProxy(socket.RemoteAddr()) {
+		return socket, nil
+	}
+
+	socket.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	br := bufio.NewReader(socket)
+	remote, err := readProxyHeader(br)
+	socket.SetReadDeadline(time.Time{})
+	if err != nil {
+		socket.Close()
+		return nil, fmt.Errorf("bad PROXY protocol header from %s: %s", socket.RemoteAddr(), err)
+	}
+
+	if remote == nil {
+		/* health checks and the like; nothing was proxied */
+		remote = socket.RemoteAddr()
+	} else {
+		log.Debugf("[hub] connection from %s proxied by %s", remote, socket.RemoteAddr())
+	}
+	return &proxiedConn{Conn: socket, r: br, remote: remote}, nil
+}
+
+// trustsProxy checks whether a connection from the given address is
+// from one of the Hub's TrustedProxies.
+//
+func (h *Hub) trustsProxy(addr net.Addr) bool {
+	return matchAddress(h.TrustedProxies, addr)
+}
+
+// allowsAddress checks whether an agent may connect from the given
+// address, per the Hub's AllowFrom list.
+//
+func (h *Hub) allowsAddress(addr net.Addr) bool {
+	return len(h.AllowFrom) == 0 || matchAddress(h.AllowFrom, addr)
+}
+
+// matchAddress checks a network address against a list of IP
+// addresses, CIDR ranges, and glob patterns.
+//
+func matchAddress(patterns []string, addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	subject := addr.String()
+	if host, _, err := net.SplitHostPort(subject); err == nil {
+		subject = host
+	}
+
+	for _, pattern := range patterns {
+		if matchSubject(pattern, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads a PROXY protocol header, either v1 (text) or
+// v2 (binary), and returns the source address it carries.  A nil
+// address (and a nil error) means that the header did not carry one,
+// as with v1 UNKNOWN or v2 LOCAL headers.
+//
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, fmt.Errorf("no PROXY protocol header found")
+}
+
+// readProxyHeaderV1 reads a header like:
+//
+//     PROXY TCP4 192.0.2.1 198.51.100.1 56324 4771\r\n
+//
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header: the signature, the version
+// and command, the address family and protocol, the length of the
+// rest of the header, and then the addresses (and ports), followed by
+// any TLVs, which we skip.
+//
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", hdr[12]>>4)
+	}
+
+	rest := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	switch hdr[12] & 0x0f {
+	case 0x0: /* LOCAL */
+		return nil, nil
+	case 0x1: /* PROXY */
+	default:
+		return nil, fmt.Errorf("unsupported command %d", hdr[12]&0x0f)
+	}
+
+	switch hdr[13] >> 4 {
+	case 0x1: /* AF_INET */
+		if len(rest) < 12 {
+			return nil, fmt.Errorf("truncated v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(rest[0:4]), Port: int(binary.BigEndian.Uint16(rest[8:10]))}, nil
+	case 0x2: /* AF_INET6 */
+		if len(rest) < 36 {
+			return nil, fmt.Errorf("truncated v2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(rest[0:16]), Port: int(binary.BigEndian.Uint16(rest[32:34]))}, nil
+	default:
+		/* AF_UNSPEC or AF_UNIX; nothing useful to record */
+		return nil, nil
+	}
+}
+
+// proxiedConn is a connection that came in through a load balancer,
+// which reports the agent's address as its RemoteAddr(), and reads
+// through whatever we buffered while reading the PROXY header.
+//
+type proxiedConn struct {
+	net.Conn
+	r      io.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
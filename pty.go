@@ -0,0 +1,312 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+)
+
+// The wire format of a "pty-req" request, per section 6.2 of RFC-4254.
+//
+type ptyRequest struct {
+	Term   string
+	Cols   uint32
+	Rows   uint32
+	Width  uint32
+	Height uint32
+	Modes  string
+}
+
+// The wire format of a "window-change" request, per section 6.7 of
+// RFC-4254.
+//
+type windowChange struct {
+	Cols   uint32
+	Rows   uint32
+	Width  uint32
+	Height uint32
+}
+
+// A WindowSize is the size of a terminal, in characters.
+//
+type WindowSize struct {
+	Cols int
+	Rows int
+}
+
+// A PTY is the Hub's end of an interactive terminal session with an
+// agent, as opened by OpenPTY().  Reading from it yields the output
+// of the remote terminal, and writing to it sends keystrokes.
+//
+type PTY struct {
+	agent   string
+	channel ssh.Channel
+	exit    chan status
+	done    sync.Once
+	st      status
+}
+
+// OpenPTY opens an interactive terminal session on an agent (by name),
+// for the given terminal type (i.e. "xterm") and window size.  The agent
+// must have opted in to interactive sessions, by setting its Interactive
+// handler.
+//
+// Unlike Send(), the session does not wait for any other messages that
+// are queued up for the agent.  The context governs how long to wait
+// for the session to be set up; once it is, the caller must Close()
+// the PTY when finished with it.
+//
+func (h *Hub) OpenPTY(ctx context.Context, agent, term string, cols, rows int) (*PTY, error) {
+	c, err := h.connected(agent)
+	if err != nil {
+		return nil, err
+	}
+
+	channel, requests, err := c.openChannel(ctx, "session", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pty := &PTY{
+		agent:   agent,
+		channel: channel,
+		exit:    make(chan status, 1),
+	}
+	go pty.serviceRequests(requests)
+
+	ok, err := channel.SendRequest("pty-req", true, ssh.Marshal(&ptyRequest{
+		Term: term,
+		Cols: uint32(cols),
+		Rows: uint32(rows),
+	}))
+	if err == nil && !ok {
+		err = fmt.Errorf("agent '%s' refused to allocate a pseudo-terminal", agent)
+	}
+	if err == nil {
+		ok, err = channel.SendRequest("shell", true, nil)
+		if err == nil && !ok {
+			err = fmt.Errorf("agent '%s' refused to start an interactive session", agent)
+		}
+	}
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	log.Infof("[hub] opened interactive %s session (%dx%d) on agent '%s'", term, cols, rows, agent)
+	return pty, nil
+}
+
+// serviceRequests (which ought to be run in a goroutine) waits for
+// the remote end to report the exit status of the session.
+//
+func (p *PTY) serviceRequests(in <-chan *ssh.Request) {
+	for r := range in {
+		if st, ok := exitStatus(r); ok {
+			p.exit <- st
+			continue
+		}
+		if r.WantReply {
+			r.Reply(false, nil)
+		}
+	}
+	select {
+	case p.exit <- status{err: fmt.Errorf("agent disconnected prematurely")}:
+	default:
+	}
+}
+
+// Read output from the remote terminal.
+//
+func (p *PTY) Read(b []byte) (int, error) {
+	return p.channel.Read(b)
+}
+
+// Write input to the remote terminal.
+//
+func (p *PTY) Write(b []byte) (int, error) {
+	return p.channel.Write(b)
+}
+
+// Resize informs the remote terminal that its window has changed size.
+//
+func (p *PTY) Resize(cols, rows int) error {
+	_, err := p.channel.SendRequest("window-change", false, ssh.Marshal(&windowChange{
+		Cols: uint32(cols),
+		Rows: uint32(rows),
+	}))
+	return err
+}
+
+// Wait blocks until the interactive session is over, and returns the
+// exit code of the remote terminal's handler (or the error it failed
+// with).
+//
+func (p *PTY) Wait() (int, error) {
+	p.done.Do(func() {
+		p.st = <-p.exit
+	})
+	return p.st.code, p.st.err
+}
+
+// Close hangs up the interactive session.
+//
+func (p *PTY) Close() error {
+	log.Infof("[hub] closing interactive session on agent '%s'", p.agent)
+	return p.channel.Close()
+}
+
+// A Terminal is the Agent's end of an interactive terminal session,
+// as passed to its Interactive handler.  Reading from it yields the
+// keystrokes sent by the Hub caller, and writing to it sends output
+// back to them.
+//
+type Terminal struct {
+	// The terminal type (i.e. "xterm" or "vt100"), as requested
+	// by the Hub caller.
+	//
+	Term string
+
+	channel ssh.Channel
+
+	lk      sync.Mutex
+	size    WindowSize
+	resizes chan WindowSize
+
+	in, out int64
+}
+
+// A TerminalHandler services an interactive terminal session on an
+// Agent, until the session is over, returning an exit code.  The
+// context is cancelled when the Hub hangs up.
+//
+type TerminalHandler func(ctx context.Context, t *Terminal) (int, error)
+
+func (t *Terminal) Read(b []byte) (int, error) {
+	n, err := t.channel.Read(b)
+	t.lk.Lock()
+	t.in += int64(n)
+	t.lk.Unlock()
+	return n, err
+}
+
+func (t *Terminal) Write(b []byte) (int, error) {
+	n, err := t.channel.Write(b)
+	t.lk.Lock()
+	t.out += int64(n)
+	t.lk.Unlock()
+	return n, err
+}
+
+// Size returns the current window size of the terminal.
+//
+func (t *Terminal) Size() WindowSize {
+	t.lk.Lock()
+	defer t.lk.Unlock()
+	return t.size
+}
+
+// Resizes returns a channel on which changes to the window size of the
+// terminal are delivered.  If the handler falls behind, intermediate
+// sizes are dropped; Size() always returns the latest.  The channel is
+// closed once the Hub can no longer resize the terminal (i.e. when the
+// session ends).
+//
+func (t *Terminal) Resizes() <-chan WindowSize {
+	return t.resizes
+}
+
+func (t *Terminal) resize(size WindowSize) {
+	t.lk.Lock()
+	t.size = size
+	t.lk.Unlock()
+
+	select {
+	case t.resizes <- size:
+	default:
+	}
+}
+
+// serveTerminal services an interactive session channel, once the Hub
+// has asked for a pseudo-terminal, handling window changes, and running
+// the Agent's Interactive handler once the Hub asks for a shell.
+//
+// This method is meant to be called in a goroutine.
+//
+func (a *Agent) serveTerminal(hub string, ch ssh.Channel, reqs <-chan *ssh.Request, req ptyRequest) {
+	t := &Terminal{
+		Term:    req.Term,
+		channel: ch,
+		size:    WindowSize{Cols: int(req.Cols), Rows: int(req.Rows)},
+		resizes: make(chan WindowSize, 1),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	started := false
+	for r := range reqs {
+		switch r.Type {
+		case "window-change":
+			var wc windowChange
+			if err := ssh.Unmarshal(r.Payload, &wc); err == nil {
+				t.resize(WindowSize{Cols: int(wc.Cols), Rows: int(wc.Rows)})
+			}
+			if r.WantReply {
+				r.Reply(true, nil)
+			}
+
+		case "shell":
+			if started {
+				r.Reply(false, nil)
+				continue
+			}
+			started = true
+			r.Reply(true, nil)
+			go a.runTerminal(ctx, hub, t)
+
+		default:
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+		}
+	}
+
+	/* no more window changes are coming */
+	close(t.resizes)
+}
+
+// runTerminal runs the Agent's Interactive handler against a Terminal,
+// auditing the start and end of the session, and reporting the outcome
+// back to the Hub.
+//
+func (a *Agent) runTerminal(ctx context.Context, hub string, t *Terminal) {
+	size := t.Size()
+	a.audit(hub, "pty-open", "interactive %s session (%dx%d) opened", t.Term, size.Cols, size.Rows)
+
+	start := time.Now()
+	rc, err := a.Interactive(ctx, t)
+
+	t.lk.Lock()
+	in, out := t.in, t.out
+	t.lk.Unlock()
+
+	if err != nil {
+		sig, ok := err.(*ExitSignal)
+		if !ok {
+			sig = &ExitSignal{Signal: "ABRT", Message: err.Error()}
+		}
+		a.audit(hub, "pty-close", "interactive %s session failed after %s (%d bytes in, %d bytes out): %s",
+			t.Term, time.Since(start), in, out, err)
+		t.channel.SendRequest("exit-signal", false, sig.marshal())
+	} else {
+		a.audit(hub, "pty-close", "interactive %s session exited %d after %s (%d bytes in, %d bytes out)",
+			t.Term, rc, time.Since(start), in, out)
+		t.channel.SendRequest("exit-status", false, exited(rc))
+	}
+	t.channel.Close()
+}
@@ -0,0 +1,127 @@
+package sfab
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A Registry keeps track of which Hub (by PeerAddress) each agent is
+// connected to, across a cluster of Hubs that share it.  Hubs register
+// agents as they connect, deregister them as they disconnect, and look
+// up agents that aren't connected to themselves, to find out which
+// peer Hub to forward messages to.
+//
+// Implementations must be safe to call from multiple goroutines.
+//
+type Registry interface {
+	// Register records that the named agent is connected to
+	// the given Hub.
+	//
+	Register(agent, hub string) error
+
+	// Deregister forgets that the named agent is connected to
+	// the given Hub.  If the agent has since registered with
+	// another Hub, that registration must be left alone.
+	//
+	Deregister(agent, hub string) error
+
+	// Lookup returns the Hub that the named agent is connected
+	// to, if any.
+	//
+	Lookup(agent string) (string, bool, error)
+}
+
+// A MemoryRegistry is a Registry that lives entirely in memory, for
+// clusters of Hubs that run in a single process (i.e. in tests).  The
+// zero value is ready to use.
+//
+type MemoryRegistry struct {
+	lk     sync.Mutex
+	agents map[string]string
+}
+
+func (r *MemoryRegistry) Register(agent, hub string) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.agents == nil {
+		r.agents = make(map[string]string)
+	}
+	r.agents[agent] = hub
+	return nil
+}
+
+func (r *MemoryRegistry) Deregister(agent, hub string) error {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	if r.agents[agent] == hub {
+		delete(r.agents, agent)
+	}
+	return nil
+}
+
+func (r *MemoryRegistry) Lookup(agent string) (string, bool, error) {
+	r.lk.Lock()
+	defer r.lk.Unlock()
+
+	hub, ok := r.agents[agent]
+	return hub, ok, nil
+}
+
+// A FileRegistry is a Registry that keeps one small file per agent in
+// a directory (Path), which can be shared by Hubs running on the same
+// host, or across hosts, via a shared filesystem.  The directory must
+// already exist.
+//
+type FileRegistry struct {
+	Path string
+}
+
+func (r FileRegistry) file(agent string) string {
+	return filepath.Join(r.Path, hex.EncodeToString([]byte(agent)))
+}
+
+func (r FileRegistry) Register(agent, hub string) error {
+	tmp, err := ioutil.TempFile(r.Path, ".register-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write([]byte(hub)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.file(agent))
+}
+
+func (r FileRegistry) Deregister(agent, hub string) error {
+	current, ok, err := r.Lookup(agent)
+	if err != nil || !ok || current != hub {
+		return err
+	}
+
+	err = os.Remove(r.file(agent))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (r FileRegistry) Lookup(agent string) (string, bool, error) {
+	b, err := ioutil.ReadFile(r.file(agent))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(b), true, nil
+}
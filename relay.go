@@ -0,0 +1,183 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+)
+
+// The SSH channel type that Agents open to the Hub they are
+// connected to, to have a message relayed to another agent.
+//
+const RelayChannelType = "sfab-relay"
+
+// The wire format of a relay request, as the extra data of the
+// channel open request.
+//
+type relayRequest struct {
+	Target  string
+	Payload []byte
+}
+
+// A RelayPolicy decides whether or not one agent (from) may send
+// messages to another (to), via the Hub, using SendTo().
+//
+type RelayPolicy func(from, to string) bool
+
+// A RelayRule allows agents whose identities match the From pattern
+// to send messages to agents whose identities match the To pattern.
+// Patterns are globs, like the ones used for authorization subjects.
+//
+type RelayRule struct {
+	From string
+	To   string
+}
+
+// RelayRules builds a RelayPolicy that allows a relay if (and only
+// if) at least one of the given rules allows it.
+//
+func RelayRules(rules ...RelayRule) RelayPolicy {
+	return func(from, to string) bool {
+		for _, rule := range rules {
+			if glob(rule.From, from) && glob(rule.To, to) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// SendTo sends a message to another agent (by name), via the Hub that
+// this Agent is currently connected to.  The Hub must allow it, via its
+// RelayPolicy.
+//
+// The message is executed by the target agent's Handler, just as if
+// it had been sent by the Hub itself; output and the final exit status
+// come back as Responses, in the same way as Hub.Send().  Cancelling
+// the context aborts the execution.
+//
+// An agent cannot send messages to itself.
+//
+func (a *Agent) SendTo(ctx context.Context, agent string, message []byte) (chan *Response, error) {
+	if agent == a.Identity {
+		return nil, fmt.Errorf("cannot send messages to self")
+	}
+
+	conn, err := a.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("[agent %s] asking hub to relay message to agent '%s'...", a.Identity, agent)
+	channel, requests, err := conn.OpenChannel(RelayChannelType, ssh.Marshal(&relayRequest{
+		Target:  agent,
+		Payload: message,
+	}))
+	if err != nil {
+		if oc, ok := err.(*ssh.OpenChannelError); ok {
+			return nil, fmt.Errorf("hub refused to relay message to agent '%s': %s", agent, oc.Message)
+		}
+		return nil, err
+	}
+
+	s := &session{
+		channel:  channel,
+		requests: requests,
+		exit:     make(chan status, 1),
+		ctx:      ctx,
+	}
+	go s.serviceRequests()
+
+	responses := make(chan *Response)
+	go s.finish(responses, nil)
+	return responses, nil
+}
+
+// serviceChannels (which ought to be run in a goroutine) handles new
+// channels opened by the remote Agent, relaying messages to other
+// agents, and refusing everything else.
+//
+func (c *connection) serviceChannels(in <-chan ssh.NewChannel) {
+	for newch := range in {
+		switch newch.ChannelType() {
+		case RelayChannelType:
+			go c.hub.relay(c, newch)
+
+		default:
+			newch.Reject(ssh.Prohibited, fmt.Sprintf("read my lips -- no new %s channels", newch.ChannelType()))
+		}
+	}
+}
+
+// relay handles a relay channel opened by an agent, checking the relay
+// against the RelayPolicy, and then sending the message on to its target,
+// relaying its input, output and exit status back and forth.
+//
+func (h *Hub) relay(c *connection, newch ssh.NewChannel) {
+	var req relayRequest
+	if err := ssh.Unmarshal(newch.ExtraData(), &req); err != nil {
+		newch.Reject(ssh.ConnectionFailed, "malformed relay request")
+		return
+	}
+
+	if !h.keys.Authorized(c.identity, c.key) {
+		newch.Reject(ssh.Prohibited, "agent not authorized")
+		return
+	}
+	if req.Target == c.identity || h.RelayPolicy == nil || !h.RelayPolicy(c.identity, req.Target) {
+		log.Infof("[hub] refusing to relay message from agent '%s' to agent '%s'", c.identity, req.Target)
+		newch.Reject(ssh.Prohibited, "relay not allowed")
+		return
+	}
+
+	ch, reqs, err := newch.Accept()
+	if err != nil {
+		log.Errorf("[hub] failed to accept relay channel from agent '%s': %s", c.identity, err)
+		return
+	}
+	defer ch.Close()
+
+	/* abort the relayed execution if the sender hangs up */
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for r := range reqs {
+			r.Reply(false, nil)
+		}
+		cancel()
+	}()
+
+	log.Infof("[hub] relaying message from agent '%s' to agent '%s'", c.identity, req.Target)
+	responses, err := h.send(ctx, req.Target, Message{
+		payload: req.Payload,
+		raw:     true,
+		stdin:   ch,
+		ctx:     ctx,
+	})
+	if err != nil {
+		ch.SendRequest("exit-signal", false, (&ExitSignal{Message: err.Error()}).marshal())
+		return
+	}
+
+	relayResponses(ch, responses)
+}
+
+// relayResponses copies the (raw) output of an execution to an SSH
+// channel, followed by its exit status, as an Agent would send them.
+//
+func relayResponses(ch ssh.Channel, responses chan *Response) {
+	for r := range responses {
+		switch {
+		case r.IsStdout():
+			ch.Write(r.Bytes())
+		case r.IsStderr():
+			ch.Stderr().Write(r.Bytes())
+		case r.IsExit():
+			ch.SendRequest("exit-status", false, exited(r.ExitCode()))
+		case r.IsError():
+			ch.SendRequest("exit-signal", false, (&ExitSignal{Message: r.Error().Error()}).marshal())
+		}
+	}
+}
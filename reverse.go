@@ -0,0 +1,160 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/jhunt/go-log"
+)
+
+// ListenAndServe puts the Agent into "listen" mode, for networks where
+// the Agent cannot dial out to its Hub(s): it binds the given address
+// (i.e. "0.0.0.0:4771"), and waits for Hubs to connect to it, via their
+// DialAgent() method.  Only the direction of the TCP connection is
+// reversed; the Agent still authenticates to the Hub with its identity
+// and private key, and verifies the Hub's host key, much as it does
+// when it dials out (so be sure to authorize your Hubs' host keys).
+//
+// Since Hubs dial in from ephemeral ports, and have no name to speak
+// of, their host keys are checked against their IP address alone, both
+// for AuthorizeKey() and in the KnownHostsFile.  For the same reason,
+// TrustOnFirstUse is refused: anyone who can reach the listener would
+// get to pose as a Hub.
+//
+// Several Hubs may be connected at once; as with ConnectAll(), use
+// HubFromContext() to tell them apart (by IP address).  This method
+// blocks until the Handler asks for the Agent to terminate (returning
+// nil), or until the listener fails.
+//
+func (a *Agent) ListenAndServe(bind string, handler StreamHandler) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	if a.TrustOnFirstUse {
+		return fmt.Errorf("cannot trust hub host keys on first use in listen mode; authorize them instead")
+	}
+
+	l, err := net.Listen("tcp", bind)
+	if err != nil {
+		return err
+	}
+
+	handler = a.rpc(handler)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var (
+		wg     sync.WaitGroup
+		halted = make(chan struct{})
+		once   sync.Once
+	)
+
+	log.Infof("[agent %s] listening for hubs on %s", a.Identity, l.Addr())
+	for {
+		socket, err := l.Accept()
+		if err != nil {
+			select {
+			case <-halted:
+				wg.Wait()
+				return nil
+			default:
+				return err
+			}
+		}
+
+		hub := socket.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(hub); err == nil {
+			hub = host
+		}
+		log.Infof("[agent %s] accepted connection from hub %s", a.Identity, hub)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer a.forgetHub(hub)
+
+			halt, err := a.serve(ctx, hub, socket, handler)
+			if halt {
+				once.Do(func() { close(halted) })
+				cancel()
+				return
+			}
+			if err != nil {
+				log.Errorf("[agent %s] unable to serve hub %s: %s", a.Identity, hub, err)
+			} else {
+				log.Infof("[agent %s] lost connection to hub %s", a.Identity, hub)
+			}
+		}()
+	}
+}
+
+// DialAgent connects to an Agent that is waiting for Hubs to connect
+// to it (via its ListenAndServe() method), at the given address.  Once
+// connected, the Agent is registered with the Hub exactly as if it had
+// connected inbound, and is subject to the same authorization checks.
+// Additionally, the Agent must identify itself with the expected
+// identity, and authenticate with the expected key; otherwise the
+// connection is refused.
+//
+// The context bounds the connection attempt (including the SSH
+// handshake), but not the lifetime of the connection itself.  The Hub
+// need not be listening for inbound connections, but must have a
+// HostKey, as always.
+//
+func (h *Hub) DialAgent(ctx context.Context, addr, identity string, key *Key) error {
+	if identity == "" || identity == PeerUser {
+		return fmt.Errorf("invalid agent identity '%s'", identity)
+	}
+	if key == nil {
+		return fmt.Errorf("missing expected key for agent '%s'", identity)
+	}
+
+	if err := h.ready(); err != nil {
+		return err
+	}
+
+	log.Infof("[hub] dialing agent '%s' at %s...", identity, addr)
+	dialer := &net.Dialer{}
+	socket, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	/* give up on the handshake when the caller tells us to */
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			socket.Close()
+		case <-stop:
+		}
+	}()
+	c, chans, reqs, err := h.handshake(socket)
+	close(stop)
+	if ctx.Err() != nil {
+		if err == nil {
+			c.Close()
+		}
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	if c.User() != identity {
+		c.Close()
+		return fmt.Errorf("agent at %s identified itself as '%s', not '%s'", addr, c.User(), identity)
+	}
+	if fp := c.Permissions.Extensions[PublicKeyExtensionName]; fp != key.Fingerprint() {
+		c.Close()
+		return fmt.Errorf("agent '%s' at %s authenticated with unexpected key [%s]", identity, addr, fp)
+	}
+
+	return h.admit(c, chans, reqs)
+}
@@ -0,0 +1,187 @@
+package sfab
+
+import (
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// The name of the SSH global request that Agents use to
+	// submit a key rotation to the Hub they are connected to.
+	//
+	RotationRequestName = "sfab-rotate"
+
+	rotationMagic   = "sfab-rotate-v1"
+	rotationPEMType = "SFAB KEY ROTATION"
+)
+
+// A Rotation is a request, from an Agent to a Hub, to start trusting
+// a new public key for the Agent's identity, in place of the key that
+// the Agent is currently authorized to use.  To prove that the request
+// comes from the holder of the current key, it is signed by the current
+// private key.
+//
+type Rotation struct {
+	// The identity (agent name) that the new key is for.
+	//
+	Identity string
+
+	// The new public key that the Agent wants to rotate to.
+	//
+	NewKey *Key
+
+	// The signature, made by the current private key, over the
+	// identity and the new public key.
+	//
+	signature *ssh.Signature
+}
+
+// The part of a Rotation that is signed by the current key.
+//
+type rotationBody struct {
+	Magic    string
+	Identity string
+	NewKey   []byte
+}
+
+// The wire format of a Rotation, both in the SSH global request
+// and inside of the PEM-encoded form.
+//
+type rotationWire struct {
+	Identity  string
+	NewKey    []byte
+	Signature []byte
+}
+
+func (r Rotation) signed() []byte {
+	return ssh.Marshal(&rotationBody{
+		Magic:    rotationMagic,
+		Identity: r.Identity,
+		NewKey:   r.NewKey.sshpub.Marshal(),
+	})
+}
+
+// NewRotation creates a Rotation for the given identity, from the
+// current key pair (which must include the private component) to the
+// next key pair (of which only the public component is needed).
+//
+func NewRotation(identity string, current, next *Key) (*Rotation, error) {
+	if current == nil || !current.IsPrivateKey() {
+		return nil, fmt.Errorf("missing current private key")
+	}
+	if next == nil || next.sshpub == nil {
+		return nil, fmt.Errorf("missing new public key")
+	}
+
+	r := &Rotation{
+		Identity: identity,
+		NewKey:   next.Public(),
+	}
+
+	sig, err := current.signer.Sign(rand.Reader, r.signed())
+	if err != nil {
+		return nil, err
+	}
+	r.signature = sig
+	return r, nil
+}
+
+// Verify checks that the Rotation was signed by the given (current)
+// public key.
+//
+func (r Rotation) Verify(current *Key) error {
+	if current == nil || current.sshpub == nil {
+		return fmt.Errorf("missing current public key")
+	}
+	if r.NewKey == nil || r.NewKey.sshpub == nil {
+		return fmt.Errorf("missing new public key")
+	}
+	if r.signature == nil {
+		return fmt.Errorf("key rotation is not signed")
+	}
+	return current.sshpub.Verify(r.signed(), r.signature)
+}
+
+// Marshal returns the SSH wire format of the Rotation.
+//
+func (r Rotation) Marshal() []byte {
+	var sig []byte
+	if r.signature != nil {
+		sig = ssh.Marshal(r.signature)
+	}
+	return ssh.Marshal(&rotationWire{
+		Identity:  r.Identity,
+		NewKey:    r.NewKey.sshpub.Marshal(),
+		Signature: sig,
+	})
+}
+
+// UnmarshalRotation parses the SSH wire format of a Rotation, as
+// produced by Marshal().
+//
+func UnmarshalRotation(b []byte) (*Rotation, error) {
+	var w rotationWire
+	if err := ssh.Unmarshal(b, &w); err != nil {
+		return nil, err
+	}
+
+	pub, err := ssh.ParsePublicKey(w.NewKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := wrapPublic(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &ssh.Signature{}
+	if err := ssh.Unmarshal(w.Signature, sig); err != nil {
+		return nil, err
+	}
+
+	return &Rotation{
+		Identity:  w.Identity,
+		NewKey:    key,
+		signature: sig,
+	}, nil
+}
+
+// Encode the Rotation as a PEM block, suitable for storing in a file
+// or shipping to an Agent out-of-band.
+//
+func (r Rotation) Encode() []byte {
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  rotationPEMType,
+		Bytes: r.Marshal(),
+	})
+}
+
+func (r Rotation) EncodeString() string {
+	return string(r.Encode())
+}
+
+// ParseRotation decodes a PEM-encoded Rotation, as produced by the
+// Encode() method.
+//
+func ParseRotation(b []byte) (*Rotation, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("unrecognized key rotation format: no pem blocks found")
+	}
+	if block.Type != rotationPEMType {
+		return nil, fmt.Errorf("unrecognized key rotation type '%s'", block.Type)
+	}
+	return UnmarshalRotation(block.Bytes)
+}
+
+func ParseRotationFromFile(f string) (*Rotation, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRotation(b)
+}
@@ -0,0 +1,433 @@
+package sfab
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// The verb that prefixes all RPC payloads sent from a Hub to an
+	// Agent.  The full header line is
+	//
+	//     sfab-rpc <codec> <Service.Method>
+	//
+	// followed by a newline and the encoded arguments.
+	//
+	RPCPayloadPrefix = "sfab-rpc"
+
+	// How many characters of (base64-encoded) result data go into
+	// each line of RPC output, to stay well clear of line length
+	// limits on the Hub side.
+	//
+	rpcLineLength = 4096
+)
+
+var (
+	typeOfError  = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfStream = reflect.TypeOf((*Stream)(nil))
+)
+
+// An rpcMethod is a single method of a registered RPC receiver.
+//
+type rpcMethod struct {
+	method reflect.Method
+	args   reflect.Type
+	reply  reflect.Type
+	stream bool
+}
+
+// An rpcService is a registered RPC receiver, and its methods.
+//
+type rpcService struct {
+	rcvr    reflect.Value
+	methods map[string]*rpcMethod
+}
+
+// Register publishes the methods of rcvr as RPC methods that the Hub
+// can call (via Call() and CallStream()), under the name of rcvr's
+// concrete type.  See RegisterName() for the particulars.
+//
+func (a *Agent) Register(rcvr interface{}) error {
+	return a.RegisterName(reflect.Indirect(reflect.ValueOf(rcvr)).Type().Name(), rcvr)
+}
+
+// RegisterName publishes the methods of rcvr as RPC methods, under
+// the given service name.  Much like net/rpc, only methods that look
+// like this are published:
+//
+//     func (t *T) MethodName(args T1, reply *T2) error
+//
+// Methods that produce a stream of results instead look like this:
+//
+//     func (t *T) MethodName(args T1, stream *sfab.Stream) error
+//
+// If the method returns an error, it is sent back to the Hub as a
+// RemoteError, and the reply is discarded.
+//
+func (a *Agent) RegisterName(name string, rcvr interface{}) error {
+	if name == "" || !isExported(name) {
+		return fmt.Errorf("rpc service name '%s' is not exported", name)
+	}
+
+	svc := &rpcService{
+		rcvr:    reflect.ValueOf(rcvr),
+		methods: make(map[string]*rpcMethod),
+	}
+
+	t := svc.rcvr.Type()
+	for i := 0; i < t.NumMethod(); i++ {
+		m := t.Method(i)
+		if m.PkgPath != "" || m.Type.NumIn() != 3 || m.Type.NumOut() != 1 || m.Type.Out(0) != typeOfError {
+			continue
+		}
+		reply := m.Type.In(2)
+		if reply.Kind() != reflect.Ptr {
+			continue
+		}
+		svc.methods[m.Name] = &rpcMethod{
+			method: m,
+			args:   m.Type.In(1),
+			reply:  reply,
+			stream: reply == typeOfStream,
+		}
+	}
+	if len(svc.methods) == 0 {
+		return fmt.Errorf("rpc service '%s' has no suitable methods", name)
+	}
+
+	a.lk.Lock()
+	defer a.lk.Unlock()
+	if a.services == nil {
+		a.services = make(map[string]*rpcService)
+	}
+	if _, exists := a.services[name]; exists {
+		return fmt.Errorf("rpc service '%s' is already registered", name)
+	}
+	a.services[name] = svc
+	return nil
+}
+
+func isExported(name string) bool {
+	r, _ := utf8.DecodeRuneInString(name)
+	return unicode.IsUpper(r)
+}
+
+// rpc wraps a Handler, intercepting (and servicing) RPC payloads and
+// passing all others on to the wrapped Handler.
+//
+func (a *Agent) rpc(next StreamHandler) StreamHandler {
+	return func(ctx context.Context, payload []byte, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+		if bytes.HasPrefix(payload, []byte(RPCPayloadPrefix+" ")) {
+			return a.serveRPC(payload, stdout, stderr), nil
+		}
+		if next == nil {
+			fmt.Fprintf(stderr, "unknown command\n")
+			return UnknownCommandExitCode, nil
+		}
+		return next(ctx, payload, stdin, stdout, stderr)
+	}
+}
+
+// serveRPC decodes and executes a single RPC call, writing results
+// to standard output, and errors to standard error.
+//
+func (a *Agent) serveRPC(payload []byte, stdout, stderr io.Writer) int {
+	nl := bytes.IndexByte(payload, '\n')
+	if nl < 0 {
+		fmt.Fprintf(stderr, "malformed rpc request\n")
+		return 2
+	}
+	header := strings.Fields(string(payload[:nl]))
+	body := payload[nl+1:]
+	if len(header) != 3 {
+		fmt.Fprintf(stderr, "malformed rpc request\n")
+		return 2
+	}
+
+	codec, err := lookupCodec(header[1])
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return 2
+	}
+
+	var svc *rpcService
+	var m *rpcMethod
+	if dot := strings.LastIndex(header[2], "."); dot > 0 {
+		a.lk.Lock()
+		svc = a.services[header[2][:dot]]
+		a.lk.Unlock()
+		if svc != nil {
+			m = svc.methods[header[2][dot+1:]]
+		}
+	}
+	if m == nil {
+		fmt.Fprintf(stderr, "rpc: can't find method %s\n", header[2])
+		return UnknownCommandExitCode
+	}
+
+	var argv reflect.Value
+	if m.args.Kind() == reflect.Ptr {
+		argv = reflect.New(m.args.Elem())
+	} else {
+		argv = reflect.New(m.args)
+	}
+	if err := codec.Unmarshal(body, argv.Interface()); err != nil {
+		fmt.Fprintf(stderr, "rpc: unable to decode arguments for %s: %s\n", header[2], err)
+		return 2
+	}
+	if m.args.Kind() != reflect.Ptr {
+		argv = argv.Elem()
+	}
+
+	var replyv reflect.Value
+	if m.stream {
+		replyv = reflect.ValueOf(&Stream{codec: codec, w: stdout})
+	} else {
+		replyv = reflect.New(m.reply.Elem())
+	}
+
+	if err := m.call(svc.rcvr, argv, replyv); err != nil {
+		fmt.Fprintf(stderr, "%s\n", err)
+		return 1
+	}
+
+	if !m.stream {
+		b, err := codec.Marshal(replyv.Interface())
+		if err != nil {
+			fmt.Fprintf(stderr, "rpc: unable to encode reply from %s: %s\n", header[2], err)
+			return 2
+		}
+		if err := writeRPCValue(stdout, b); err != nil {
+			return 2
+		}
+	}
+	return 0
+}
+
+// writeRPCValue writes a single encoded value to the given output
+// stream, base64-encoded and split up across as many lines as it
+// takes.  Each line starts with a '+', and the whole value is then
+// terminated by a line consisting solely of a '.'.
+//
+func writeRPCValue(w io.Writer, b []byte) error {
+	var out bytes.Buffer
+	s := base64.StdEncoding.EncodeToString(b)
+	for len(s) > rpcLineLength {
+		fmt.Fprintf(&out, "+%s\n", s[:rpcLineLength])
+		s = s[rpcLineLength:]
+	}
+	fmt.Fprintf(&out, "+%s\n.\n", s)
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// A Stream is passed to streaming RPC methods, in place of a reply,
+// to let them send back any number of results to the calling Hub.
+//
+type Stream struct {
+	lk    sync.Mutex
+	codec Codec
+	w     io.Writer
+}
+
+// Send encodes a single result, and sends it to the calling Hub.
+//
+func (s *Stream) Send(v interface{}) error {
+	b, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.lk.Lock()
+	defer s.lk.Unlock()
+	return writeRPCValue(s.w, b)
+}
+
+// Results are the Hub's end of an RPC call, from which the results
+// that the remote method sends back can be read, one at a time.
+//
+type Results struct {
+	ctx       context.Context
+	codec     Codec
+	responses chan *Response
+
+	data   strings.Builder
+	stderr []string
+	done   bool
+	err    error
+}
+
+// Recv reads the next result from the remote method into v.  Once
+// there are no more results, Recv returns io.EOF if the method was
+// successful, or the error it failed with (usually a RemoteError).
+//
+// If v is nil, the next result is read, but discarded.
+//
+func (r *Results) Recv(v interface{}) error {
+	for !r.done {
+		var (
+			resp *Response
+			ok   bool
+		)
+		select {
+		case <-r.ctx.Done():
+			r.Close()
+			r.err = r.ctx.Err()
+			return r.err
+
+		case resp, ok = <-r.responses:
+		}
+
+		switch {
+		case !ok:
+			r.finish(io.ErrUnexpectedEOF)
+
+		case resp.IsStdout():
+			text := resp.Text()
+			if strings.HasPrefix(text, "+") {
+				r.data.WriteString(text[1:])
+				continue
+			}
+			if text != "." {
+				continue
+			}
+
+			b, err := base64.StdEncoding.DecodeString(r.data.String())
+			r.data.Reset()
+			if err != nil {
+				return fmt.Errorf("malformed rpc result: %s", err)
+			}
+			if v == nil {
+				return nil
+			}
+			return r.codec.Unmarshal(b, v)
+
+		case resp.IsStderr():
+			r.stderr = append(r.stderr, resp.Text())
+
+		case resp.IsError():
+			r.finish(resp.Error())
+
+		case resp.IsExit():
+			if resp.ExitCode() == 0 {
+				r.finish(io.EOF)
+			} else {
+				r.finish(&RemoteError{
+					ExitCode: resp.ExitCode(),
+					Message:  strings.Join(r.stderr, "\n"),
+				})
+			}
+		}
+	}
+	return r.err
+}
+
+func (r *Results) finish(err error) {
+	r.done = true
+	r.err = err
+}
+
+// Close discards any remaining results.  It is safe to call Close
+// on Results that have already been read to completion.
+//
+func (r *Results) Close() {
+	if !r.done {
+		r.finish(io.EOF)
+		go func() {
+			for range r.responses {
+			}
+		}()
+	}
+}
+
+// Call invokes the named RPC method (i.e. "Service.Method") on an
+// agent, with the given arguments, and waits for it to finish,
+// decoding its result into reply.  If the remote method fails,
+// a RemoteError is returned.
+//
+// The context governs how long to wait, both for the agent to pick
+// up the call, and for it to finish.  Note that the agent is not
+// told if the call is abandoned; it will run to completion anyway.
+//
+func (h *Hub) Call(ctx context.Context, agent, method string, args, reply interface{}) error {
+	results, err := h.CallStream(ctx, agent, method, args)
+	if err != nil {
+		return err
+	}
+	defer results.Close()
+
+	if err := results.Recv(reply); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("rpc: no reply from %s", method)
+		}
+		return err
+	}
+	for {
+		if err := results.Recv(nil); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// CallStream invokes the named RPC method (i.e. "Service.Method") on
+// an agent, with the given arguments, and returns the Results, from
+// which the caller can read each of the method's results in turn.
+// This is most useful for streaming methods, which take a *Stream
+// instead of a reply.
+//
+// The caller must either read the Results until Recv() returns an
+// error, or Close() them.
+//
+func (h *Hub) CallStream(ctx context.Context, agent, method string, args interface{}) (*Results, error) {
+	h.lock()
+	codec := h.RPCCodec
+	h.unlock()
+	if codec == nil {
+		codec = JSONCodec
+	}
+
+	body, err := codec.Marshal(args)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := []byte(fmt.Sprintf("%s %s %s\n", RPCPayloadPrefix, codec.Name(), method))
+	responses, err := h.send(ctx, agent, Message{payload: append(payload, body...)})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Results{
+		ctx:       ctx,
+		codec:     codec,
+		responses: responses,
+	}, nil
+}
+
+// call invokes an RPC method, turning a panic into an error, so that
+// a misbehaving method fails its caller, rather than the whole Agent.
+//
+func (m *rpcMethod) call(rcvr, argv, replyv reflect.Value) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rpc: panic in %s: %v", m.method.Name, r)
+		}
+	}()
+
+	out := m.method.Func.Call([]reflect.Value{rcvr, argv, replyv})
+	if e := out[0].Interface(); e != nil {
+		return e.(error)
+	}
+	return nil
+}
@@ -2,14 +2,23 @@ package sfab
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"sync"
+	"time"
 
+	"github.com/jhunt/go-log"
 	"golang.org/x/crypto/ssh"
 )
 
+// How much output (at most) each raw-mode Response
+// carries; see drainRaw().
+//
+const rawChunkSize = 32 * 1024
+
 // A status wraps up the possible result of a
 // remote execution; either it exits normally,
 // with a Unix-style return code (code), or it
@@ -27,7 +36,8 @@ type status struct {
 // connection.
 //
 type session struct {
-	// The connection that spawned us.
+	// The connection that spawned us (on the Hub),
+	// or nil, for relayed sessions (on an Agent).
 
 	connection *connection
 
@@ -42,11 +52,26 @@ type session struct {
 	//
 	requests <-chan *ssh.Request
 
-	// A channel we will listen to (in finish()) for
-	// the ultimate exit status (code or error) of
-	// the remote execution.
+	// A (buffered) channel we will listen to (in
+	// finish()) for the ultimate exit status (code
+	// or error) of the remote execution.
 	//
 	exit chan status
+
+	// Whether or not to relay output as raw chunks
+	// of bytes (see drainRaw()), instead of lines.
+	//
+	raw bool
+
+	// An optional input stream to copy to the remote
+	// end, as the standard input of the execution.
+	//
+	stdin io.Reader
+
+	// An optional context that aborts the execution
+	// (by closing the channel) when it is done.
+	//
+	ctx context.Context
 }
 
 // serviceRequests (which ought to be run in a
@@ -55,35 +80,55 @@ type session struct {
 // the details of the "exit-status" (normal exit)
 // and "exit-signal" (abnormal exit) requests.
 //
+// If the channel goes away before either of those
+// arrives, that is reported as an exit status too.
+// (The exit channel must be buffered, for this.)
+//
 func (s *session) serviceRequests() {
 	for r := range s.requests {
-		switch r.Type {
-		case "exit-status":
-			s.exit <- status{code: int(binary.BigEndian.Uint32(r.Payload))}
+		if st, ok := exitStatus(r); ok {
+			s.exit <- st
 			return
+		}
+		if r.WantReply {
+			r.Reply(false, nil)
+		}
+	}
 
-		case "exit-signal":
-			var sig struct {
-				Signal     string
-				CoreDumped bool
-				Error      string
-				Lang       string
-			}
-			if err := ssh.Unmarshal(r.Payload, &sig); err != nil {
-				s.exit <- status{err: fmt.Errorf("failed to unmarshal SSH request: %s", err)}
-			} else if sig.Signal != "" {
-				s.exit <- status{err: fmt.Errorf("remote error (%s): %s", sig.Signal, sig.Error)}
-			} else {
-				s.exit <- status{err: fmt.Errorf("remote error: %s", sig.Error)}
-			}
-			return
+	select {
+	case s.exit <- status{err: fmt.Errorf("agent disconnected prematurely")}:
+	default:
+	}
+}
 
-		default:
-			if r.WantReply {
-				r.Reply(false, nil)
-			}
+// exitStatus interprets an "exit-status" (normal exit)
+// or "exit-signal" (abnormal exit) request from the
+// remote Agent, returning false for any other request.
+//
+func exitStatus(r *ssh.Request) (status, bool) {
+	switch r.Type {
+	case "exit-status":
+		if len(r.Payload) < 4 {
+			return status{err: fmt.Errorf("malformed exit-status request")}, true
+		}
+		return status{code: int(binary.BigEndian.Uint32(r.Payload))}, true
+
+	case "exit-signal":
+		var sig struct {
+			Signal     string
+			CoreDumped bool
+			Error      string
+			Lang       string
+		}
+		if err := ssh.Unmarshal(r.Payload, &sig); err != nil {
+			return status{err: fmt.Errorf("failed to unmarshal SSH request: %s", err)}, true
+		} else if sig.Signal != "" {
+			return status{err: fmt.Errorf("remote error (%s): %s", sig.Signal, sig.Error)}, true
+		} else {
+			return status{err: fmt.Errorf("remote error: %s", sig.Error)}, true
 		}
 	}
+	return status{}, false
 }
 
 // Starts the remote execution of the given payload.
@@ -110,32 +155,68 @@ func (s *session) start(payload string) error {
 // the output and exit status stuff.
 //
 func (s *session) finish(reply chan *Response, reaper chan int) {
+	drain := s.drain
+	if s.raw {
+		drain = s.drainRaw
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go s.drain(&wg, fromStdout, s.channel, reply)
-	go s.drain(&wg, fromStderr, s.channel.Stderr(), reply)
-	s.channel.CloseWrite()
+	go drain(&wg, fromStdout, s.channel, reply)
+	go drain(&wg, fromStderr, s.channel.Stderr(), reply)
+
+	if s.stdin != nil {
+		go func() {
+			io.Copy(s.channel, s.stdin)
+			s.channel.CloseWrite()
+		}()
+	} else {
+		s.channel.CloseWrite()
+	}
+
+	var aborted <-chan struct{}
+	if s.ctx != nil {
+		aborted = s.ctx.Done()
+	}
+
+	/* don't leave the reaper hanging, once we're done */
+	reaped := func() {
+		if reaper != nil {
+			go func() { <-reaper }()
+		}
+	}
 
 	var final *Response
 	select {
 	case rc := <-s.exit:
-		go func() { <-reaper }()
+		reaped()
 		if rc.err != nil {
 			final = &Response{
 				from: fromError,
 				err:  rc.err,
+				at:   time.Now(),
 			}
 		} else {
 			final = &Response{
 				from: fromExit,
 				rc:   rc.code,
+				at:   time.Now(),
 			}
 		}
 
+	case <-aborted:
+		reaped()
+		final = &Response{
+			from: fromError,
+			err:  s.ctx.Err(),
+			at:   time.Now(),
+		}
+
 	case <-reaper:
 		final = &Response{
 			from: fromError,
 			err:  fmt.Errorf("agent disconnected prematurely"),
+			at:   time.Now(),
 		}
 	}
 
@@ -148,16 +229,62 @@ func (s *session) finish(reply chan *Response, reaper chan int) {
 
 // Drains output from a given source, to a Response
 // channel, and when the input is exhausted, fulfills
-// the WaitGroup obligation passed in.
+// the WaitGroup obligation passed in.  Output that
+// cannot be split into lines (i.e. a line longer than
+// bufio.MaxScanTokenSize) is reported as an error, and
+// the rest of it is discarded.
 //
 // (This mostly cleans up other code).
 //
-func (*session) drain(wg *sync.WaitGroup, whence from, in io.Reader, out chan *Response) {
+func (s *session) drain(wg *sync.WaitGroup, whence from, in io.Reader, out chan *Response) {
 	b := bufio.NewScanner(in)
 	for b.Scan() {
 		out <- &Response{
 			from: whence,
 			text: b.Text(),
+			at:   time.Now(),
+		}
+	}
+	if err := b.Err(); err != nil {
+		if s.connection != nil {
+			log.Errorf("[hub] unable to read output from agent '%s' (try SendRaw() instead): %s", s.connection.identity, err)
+		} else {
+			log.Errorf("unable to read relayed output: %s", err)
+		}
+		out <- &Response{
+			from: fromError,
+			err:  fmt.Errorf("unable to read output (try SendRaw() instead): %s", err),
+			at:   time.Now(),
+		}
+		io.Copy(ioutil.Discard, in)
+	}
+	wg.Done()
+}
+
+// Drains output from a given source, to a Response
+// channel, verbatim, in chunks of (up to) rawChunkSize
+// bytes, tracking the offset of each chunk within the
+// output stream.  When the input is exhausted, fulfills
+// the WaitGroup obligation passed in.
+//
+func (*session) drainRaw(wg *sync.WaitGroup, whence from, in io.Reader, out chan *Response) {
+	var offset int64
+	buf := make([]byte, rawChunkSize)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			out <- &Response{
+				from:   whence,
+				data:   data,
+				offset: offset,
+				at:     time.Now(),
+			}
+			offset += int64(n)
+		}
+		if err != nil {
+			break
 		}
 	}
 	wg.Done()
@@ -0,0 +1,169 @@
+//go:build linux
+// +build linux
+
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// Shell returns a TerminalHandler that runs the given command (usually
+// a login shell, like /bin/bash) under a fresh pseudo-terminal, for the
+// duration of an interactive session.  The TERM environment variable is
+// set to the terminal type that the Hub caller asked for, and the window
+// size of the pseudo-terminal follows that of the caller's terminal.
+//
+// If the Hub hangs up, the command is killed.
+//
+func Shell(path string, args ...string) TerminalHandler {
+	return func(ctx context.Context, t *Terminal) (int, error) {
+		ptmx, tty, err := openpty()
+		if err != nil {
+			return 0, fmt.Errorf("unable to allocate pseudo-terminal: %s", err)
+		}
+		defer ptmx.Close()
+
+		setsize(ptmx, t.Size())
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case size, ok := <-t.Resizes():
+					if !ok {
+						return
+					}
+					setsize(ptmx, size)
+				}
+			}
+		}()
+
+		cmd := exec.Command(path, args...)
+		cmd.Env = append(os.Environ(), "TERM="+t.Term)
+		cmd.Stdin = tty
+		cmd.Stdout = tty
+		cmd.Stderr = tty
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Setsid:  true,
+			Setctty: true,
+		}
+		if err := cmd.Start(); err != nil {
+			tty.Close()
+			return 0, err
+		}
+		tty.Close()
+
+		go io.Copy(ptmx, t)
+		go func() {
+			<-ctx.Done()
+			cmd.Process.Kill()
+		}()
+
+		/* reading from the master side fails (with EIO)
+		   once the last process holding the slave side exits */
+		io.Copy(t, ptmx)
+
+		if err := cmd.Wait(); err != nil {
+			if exit, ok := err.(*exec.ExitError); ok {
+				if ws, ok := exit.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+					return 0, &ExitSignal{Signal: signame(ws.Signal()), Message: exit.Error()}
+				}
+				return exit.ExitCode(), nil
+			}
+			return 0, err
+		}
+		return 0, nil
+	}
+}
+
+// openpty allocates a new pseudo-terminal pair, returning the master
+// (ptmx) and slave (tty) sides.
+//
+func openpty() (*os.File, *os.File, error) {
+	ptmx, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var n uint32
+	if err := ioctl(ptmx, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+
+	var unlock int32
+	if err := ioctl(ptmx, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+
+	tty, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		ptmx.Close()
+		return nil, nil, err
+	}
+	return ptmx, tty, nil
+}
+
+// setsize sets the window size of a pseudo-terminal.
+//
+func setsize(f *os.File, size WindowSize) error {
+	ws := struct {
+		Rows, Cols, X, Y uint16
+	}{
+		Rows: uint16(size.Rows),
+		Cols: uint16(size.Cols),
+	}
+	return ioctl(f, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+}
+
+func ioctl(f *os.File, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// signame translates a signal into its RFC-4254 name (i.e. "KILL"
+// for SIGKILL).
+//
+func signame(sig syscall.Signal) string {
+	switch sig {
+	case syscall.SIGABRT:
+		return "ABRT"
+	case syscall.SIGALRM:
+		return "ALRM"
+	case syscall.SIGFPE:
+		return "FPE"
+	case syscall.SIGHUP:
+		return "HUP"
+	case syscall.SIGILL:
+		return "ILL"
+	case syscall.SIGINT:
+		return "INT"
+	case syscall.SIGKILL:
+		return "KILL"
+	case syscall.SIGPIPE:
+		return "PIPE"
+	case syscall.SIGQUIT:
+		return "QUIT"
+	case syscall.SIGSEGV:
+		return "SEGV"
+	case syscall.SIGTERM:
+		return "TERM"
+	case syscall.SIGUSR1:
+		return "USR1"
+	case syscall.SIGUSR2:
+		return "USR2"
+	}
+	return fmt.Sprintf("%d", int(sig))
+}
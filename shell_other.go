@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+// Shell returns a TerminalHandler that runs the given command under a
+// fresh pseudo-terminal.  Pseudo-terminals are only supported on Linux;
+// elsewhere, the returned handler refuses every session.
+//
+func Shell(path string, args ...string) TerminalHandler {
+	return func(ctx context.Context, t *Terminal) (int, error) {
+		return 0, fmt.Errorf("pseudo-terminals are not supported on %s", runtime.GOOS)
+	}
+}
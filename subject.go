@@ -0,0 +1,144 @@
+package sfab
+
+import (
+	"net"
+	"strings"
+)
+
+// isPattern determines whether or not an authorization subject
+// is a pattern (a glob, or a CIDR network range), rather than an
+// exact hostname, IP address, or agent name.
+//
+func isPattern(subject string) bool {
+	if strings.ContainsAny(subject, "*?[") {
+		return true
+	}
+	_, _, err := net.ParseCIDR(subject)
+	return err == nil
+}
+
+// matchSubject checks a concrete subject (a hostname, IP address,
+// or agent name) against an authorization pattern.
+//
+// CIDR patterns (i.e. 10.0.0.0/8) match IP address subjects that
+// fall inside the given network range.  All other patterns are
+// treated as shell-style globs:
+//
+//   *      matches any sequence of characters (including none)
+//   ?      matches exactly one character
+//   [...]  matches one character from the set, which may contain
+//          ranges (a-z) and may be negated with a leading ! or ^
+//
+// Unlike path.Match, a '*' will happily match a '/', since agent
+// names are not file paths.
+//
+func matchSubject(pattern, subject string) bool {
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		ip := net.ParseIP(subject)
+		return ip != nil && network.Contains(ip)
+	}
+	return glob(pattern, subject)
+}
+
+func glob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if glob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			ok, rest, valid := class(pattern[1:], s[0])
+			if !valid {
+				/* treat an unterminated class as a literal '[' */
+				if s[0] != '[' {
+					return false
+				}
+				pattern, s = pattern[1:], s[1:]
+				continue
+			}
+			if !ok {
+				return false
+			}
+			pattern, s = rest, s[1:]
+
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// class matches a single character against a glob character class,
+// (with the leading '[' already consumed), and returns whether or not
+// it matched, the rest of the pattern after the closing ']', and
+// whether or not the class was properly terminated.
+//
+func class(pattern string, c byte) (bool, string, bool) {
+	negate := false
+	if len(pattern) > 0 && (pattern[0] == '!' || pattern[0] == '^') {
+		negate = true
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == ']' && i > 0 {
+			return matched != negate, pattern[i+1:], true
+		}
+
+		lo, hi := pattern[i], pattern[i]
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			i += 2
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	return false, "", false
+}
+
+// hostSubjects enumerates all of the subjects that a Hub's host key
+// can be authorized under, given the name the Agent dialed and the
+// remote address that it actually ended up talking to.  Each of these
+// is tried both with and without the TCP port, so that authorizations
+// can be made for "hub.example.com", "hub.example.com:4000", a bare IP
+// address, or a CIDR range containing that IP address.
+//
+func hostSubjects(hostname string, remote net.Addr) []string {
+	l := []string{hostname}
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		l = append(l, host)
+	}
+
+	if remote != nil {
+		l = append(l, remote.String())
+		if host, _, err := net.SplitHostPort(remote.String()); err == nil {
+			l = append(l, host)
+		}
+	}
+	return l
+}
@@ -0,0 +1,68 @@
+package sfab
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/crypto/ssh"
+)
+
+// ConnectUpstream connects this Hub to a parent Hub, as an agent, so
+// that it can act as a relay for network segments that the parent
+// cannot reach directly.  The given Agent supplies the identity, key
+// and host key trust for the upstream connection, and its Identity
+// doubles as the namespace under which this Hub's (downstream) agents
+// are exposed to the parent: with an identity of "dc1", the parent can
+// send messages to "dc1/bob@postgres.ql", which are forwarded to the
+// agent "bob@postgres.ql", connected to this Hub.  Output and exit
+// codes flow back to the parent unchanged.
+//
+// Relays can be stacked; the parent Hub can itself be a relay for a
+// grandparent, in which case messages for "dc/dc1/bob@postgres.ql"
+// find their way down through both.
+//
+// Messages sent to the relay itself (i.e. "dc1") are refused.  Like
+// Agent.ConnectAll(), this method reconnects to the parent (after the
+// Agent's ReconnectInterval) if the connection goes away, and blocks
+// until the context is done.
+//
+func (h *Hub) ConnectUpstream(ctx context.Context, agent *Agent, parent string) error {
+	agent.lk.Lock()
+	agent.downstream = h
+	agent.lk.Unlock()
+
+	log.Infof("[hub] relaying for parent hub %s as '%s'", parent, agent.Identity)
+	return agent.ConnectAll(ctx, []string{parent}, func(_ context.Context, _ []byte, _ io.Reader, _, stderr io.Writer) (int, error) {
+		fmt.Fprintf(stderr, "'%s' is a relay hub; send messages to '%s/<agent>' instead\n", agent.Identity, agent.Identity)
+		return 1, nil
+	})
+}
+
+// namespaced finds the (connected, authorized) relay hub for a
+// namespaced agent name, like "dc1/bob@postgres.ql", by looking for
+// the longest namespace prefix that names a connected agent.  It
+// returns the relay, and the name of the agent within its namespace.
+//
+func (h *Hub) namespaced(agent string) (*connection, string, bool) {
+	for i := strings.LastIndex(agent, "/"); i > 0; i = strings.LastIndex(agent[:i], "/") {
+		if c, err := h.connected(agent[:i]); err == nil {
+			return c, agent[i+1:], true
+		}
+	}
+	return nil, "", false
+}
+
+// descend sends a message down through a relay hub, to an agent that
+// is connected to it.
+//
+func (h *Hub) descend(ctx context.Context, relay *connection, agent string, msg Message) (chan *Response, error) {
+	log.Debugf("[hub] forwarding message for agent '%s' through relay hub '%s'...", agent, relay.identity)
+	responses, err := forwardOver(ctx, relay.ssh, agent, msg)
+	if oc, ok := err.(*ssh.OpenChannelError); ok {
+		return nil, fmt.Errorf("%s (via relay hub '%s')", oc.Message, relay.identity)
+	}
+	return responses, err
+}
@@ -0,0 +1,235 @@
+package sfab
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jhunt/go-log"
+	"golang.org/x/net/websocket"
+)
+
+// WebSocketHandler returns an http.Handler that accepts agent
+// connections over WebSockets, for agents that can only reach the Hub
+// through HTTP(S) proxies.  The SSH stream is carried, unchanged, in
+// binary WebSocket frames, and the agents are registered exactly as if
+// they had connected over raw TCP.
+//
+// Mount the handler wherever you like (i.e. at /sfab), in an HTTP (or,
+// preferably, HTTPS) server of your own:
+//
+//     http.Handle("/sfab", hub.WebSocketHandler())
+//
+// and point agents at the corresponding URL (i.e. wss://hub/sfab).
+//
+func (h *Hub) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		/* agents aren't browsers; they don't send an Origin */
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			if err := h.ready(); err != nil {
+				log.Errorf("[hub] unable to accept websocket connection: %s", err)
+				return
+			}
+
+			ws.PayloadType = websocket.BinaryFrame
+			remote := h.webSocketRemote(ws.Request())
+			log.Debugf("[hub] websocket connection from %s accepted; starting SSH handshake...", remote)
+			c, chans, reqs, err := h.handshake(&wsConn{Conn: ws, remote: remote})
+			if err != nil {
+				log.Debugf("[hub] failed to negotiate SSH transport with %s: %s", remote, err)
+				return
+			}
+			if err := h.admit(c, chans, reqs); err != nil {
+				return
+			}
+
+			/* the websocket is closed as soon as we return */
+			c.Wait()
+		},
+	}
+}
+
+// A wsConn is a WebSocket whose RemoteAddr() is the network address
+// of the other end, rather than the WebSocket URL (or, on the Hub's
+// side, nothing at all), so that host key checks, AllowFrom and
+// AgentInfo() work just as they do for raw TCP connections.
+//
+type wsConn struct {
+	*websocket.Conn
+	remote net.Addr
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// httpRemoteAddr parses the RemoteAddr of an http.Request, which is
+// usually an ip:port, except for HTTP servers listening on something
+// other than TCP (i.e. a Unix domain socket).
+//
+func httpRemoteAddr(s string) net.Addr {
+	if host, port, err := net.SplitHostPort(s); err == nil {
+		ip := net.ParseIP(host)
+		n, err := strconv.ParseUint(port, 10, 16)
+		if ip != nil && err == nil {
+			return &net.TCPAddr{IP: ip, Port: int(n)}
+		}
+	}
+	return &net.UnixAddr{Name: s, Net: "unix"}
+}
+
+// webSocketRemote works out where a WebSocket connection came from:
+// the address of the HTTP client, unless that is one of the Hub's
+// TrustedProxies, in which case we believe what it (and any other
+// trusted proxies before it) says in X-Forwarded-For.
+//
+func (h *Hub) webSocketRemote(r *http.Request) net.Addr {
+	remote := httpRemoteAddr(r.RemoteAddr)
+
+	var hops []string
+	for _, v := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && h.trustsProxy(remote); i-- {
+		hop := strings.TrimSpace(hops[i])
+		if host, _, err := net.SplitHostPort(hop); err == nil {
+			hop = host
+		}
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		log.Debugf("[hub] websocket connection from %s proxied by %s", ip, remote)
+		remote = &net.TCPAddr{IP: ip}
+	}
+	return remote
+}
+
+// isWebSocket checks whether the Agent ought to connect to a Hub over
+// a WebSocket, rather than raw TCP, given the protocol and address.
+//
+func isWebSocket(proto, host string) bool {
+	return proto == "ws" || proto == "wss" ||
+		strings.HasPrefix(host, "ws://") || strings.HasPrefix(host, "wss://")
+}
+
+// hubAddress returns the host:port of a Hub, given the address the
+// Agent connects to it by, which may be a WebSocket URL (or, for the
+// "ws" and "wss" protocols, a host:port/path).  Host keys are checked
+// against this address, either way.  WebSocket URLs without a port get
+// the default port for their scheme (80 for ws://, 443 for wss://).
+//
+func hubAddress(host string) string {
+	if isWebSocket("", host) {
+		if u, err := url.Parse(host); err == nil {
+			if u.Port() != "" {
+				return u.Host
+			}
+			if u.Scheme == "wss" {
+				return net.JoinHostPort(u.Hostname(), "443")
+			}
+			return net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	if i := strings.Index(host, "/"); i > 0 {
+		return host[:i]
+	}
+	return host
+}
+
+// dialWebSocket connects to a Hub's WebSocketHandler(), given its URL
+// (i.e. wss://hub.example.com/sfab), going through a proxy if the
+// Agent's Proxy function (or, failing that, its Dialer) calls for one.
+//
+func (a *Agent) dialWebSocket(ctx context.Context, proto, host string) (net.Conn, error) {
+	if !strings.Contains(host, "://") {
+		host = proto + "://" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme '%s'", u.Scheme)
+	}
+
+	target := &url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "wss" {
+		target.Scheme = "https"
+	}
+
+	dialer := a.dialer()
+	if a.Proxy != nil {
+		via, err := a.Proxy(&http.Request{URL: target})
+		if err != nil {
+			return nil, err
+		}
+		dialer = a.Dialer
+		if dialer == nil {
+			dialer = &net.Dialer{Timeout: a.Timeout}
+		}
+		if via != nil {
+			if dialer, err = ProxyDialer(via, dialer); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(a.Timeout))
+	if u.Scheme == "wss" {
+		config := &tls.Config{}
+		if a.TLSConfig != nil {
+			config = a.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	origin := &url.URL{Scheme: target.Scheme, Host: u.Host}
+	config, err := websocket.NewConfig(u.String(), origin.String())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	ws.PayloadType = websocket.BinaryFrame
+	return &wsConn{Conn: ws, remote: conn.RemoteAddr()}, nil
+}